@@ -0,0 +1,64 @@
+package scache
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 启动后台自动 merge 协程
+func (db *DB) startAutoMerge() {
+	ctx, cancel := context.WithCancel(context.Background())
+	db.autoMergeCancel = cancel
+	db.autoMergeDone = make(chan struct{})
+	go func() {
+		defer close(db.autoMergeDone)
+		ticker := time.NewTicker(db.options.AutoMergeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if db.inAutoMergeWindow(now) {
+					db.autoMerge(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// 停止后台自动 merge 协程，取消正在进行的 merge 并等待其退出
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeCancel == nil {
+		return
+	}
+	db.autoMergeCancel()
+	<-db.autoMergeDone
+	db.autoMergeCancel = nil
+}
+
+// 无效数据的比例达到阈值时进行 merge，merge 的结果会直接安装到当前实例中
+func (db *DB) autoMerge(ctx context.Context) {
+	err := db.MergeWithOptions(ctx, DefaultMergeOptions)
+	switch err {
+	case nil, ErrMergeRatioUnreached, ErrMergeIsProgress, context.Canceled:
+	default:
+		log.Printf("auto merge failed: %v\n", err)
+	}
+}
+
+// 判断当前时间是否位于允许自动 merge 的时间窗口内
+func (db *DB) inAutoMergeWindow(now time.Time) bool {
+	start, end := db.options.AutoMergeWindowStart, db.options.AutoMergeWindowEnd
+	if start == end {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if start < end {
+		return offset >= start && offset < end
+	}
+	// 时间窗口跨过零点
+	return offset >= start || offset < end
+}
@@ -3,6 +3,7 @@ package scache
 import (
 	"encoding/binary"
 	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
 	"sync"
 	"sync/atomic"
 )
@@ -19,17 +20,20 @@ type WriteBatch struct {
 	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
 }
 
-// NewWriteBatch 初始化 WriteBatch
-func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
+// NewWriteBatch 初始化 WriteBatch，B+ 树索引无法恢复事务序列号时返回 ErrSeqNoFileNotExists
+func (db *DB) NewWriteBatch(opts WriteBatchOptions) (*WriteBatch, error) {
+	db.mu.RLock()
+	seqNoFileExists := db.seqNoFileExists
+	db.mu.RUnlock()
+	if db.options.IndexType == BPlusTree && !seqNoFileExists && !db.isInitial {
+		return nil, ErrSeqNoFileNotExists
 	}
 	return &WriteBatch{
 		options:       opts,
 		mu:            new(sync.Mutex),
 		db:            db,
 		pendingWrites: make(map[string]*data.LogRecord),
-	}
+	}, nil
 }
 
 // Put 批量写数据
@@ -55,7 +59,9 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.mu.Unlock()
 
 	// 数据不存在则直接返回
+	wb.db.mu.RLock()
 	logRecordPos := wb.db.index.Get(key)
+	wb.db.mu.RUnlock()
 	if logRecordPos == nil {
 		if wb.pendingWrites[string(key)] != nil {
 			delete(wb.pendingWrites, string(key))
@@ -85,16 +91,30 @@ func (wb *WriteBatch) Commit() error {
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
 
+	if err := wb.db.commitRecords(wb.pendingWrites, wb.options.SyncWrites); err != nil {
+		return err
+	}
+
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// 使用事务序列号将暂存的数据写到数据文件，并更新内存索引
+// 在访问此方法前必须持有互斥锁
+func (db *DB) commitRecords(pendingWrites map[string]*data.LogRecord, syncWrites bool) error {
 	// 获取当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	// 开始写数据到数据文件当中
 	positions := make(map[string]*data.LogRecordPos)
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+	for _, record := range pendingWrites {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
+			Key:    logRecordKeyWithSeq(record.Key, seqNo),
+			Value:  record.Value,
+			Type:   record.Type,
+			Expire: record.Expire,
 		})
 		if err != nil {
 			return err
@@ -107,35 +127,38 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	if _, err := db.appendLogRecord(finishedRecord); err != nil {
 		return err
 	}
 
 	// 根据配置决定是否持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+	if syncWrites && db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
 			return err
 		}
 	}
 
-	// 更新内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
-		}
+	// 更新内存索引，支持批量更新的索引在一次操作中完成
+	var records []*data.LogRecord
+	var ops []*index.BatchOp
+	for _, record := range pendingWrites {
+		records = append(records, record)
+		ops = append(ops, &index.BatchOp{
+			Key:    record.Key,
+			Pos:    positions[string(record.Key)],
+			Delete: record.Type == data.LogRecordDeleted,
+		})
+	}
+	oldPositions := index.ApplyBatch(db.index, ops)
+	for i, record := range records {
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			db.addReclaimSize(ops[i].Pos)
 		}
-		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+		if oldPositions[i] != nil {
+			db.addReclaimSize(oldPositions[i])
 		}
+		db.markKeyModified(record.Key, seqNo, oldPositions[i])
 	}
-
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
 	return nil
 }
 
@@ -0,0 +1,40 @@
+package scache
+
+import (
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
+)
+
+// 读取索引指向的数据时是否校验 crc
+func (db *DB) verifyOnRead() bool {
+	return db.options.VerifyChecksums == VerifyAlways
+}
+
+// 启动加载索引和 merge 时是否校验 crc
+func (db *DB) verifyOnScan() bool {
+	return db.options.VerifyChecksums != VerifyNever
+}
+
+// 按照 verify 决定是否校验 crc 读取记录
+func readLogRecord(dataFile *data.DataFile, offset int64, verify bool) (*data.LogRecord, int64, error) {
+	if verify {
+		return dataFile.ReadLogRecord(offset)
+	}
+	return dataFile.ReadLogRecordUnverified(offset)
+}
+
+// 活跃文件的校验算法和配置不一致时切换到新的活跃文件，写入的记录总是使用配置的校验算法编码
+// 在访问此方法前必须持有互斥锁
+func (db *DB) switchActiveFileChecksum() error {
+	if db.activeFile == nil || db.activeFile.Checksum() == db.options.Checksum {
+		return nil
+	}
+	if err := db.rotateActiveFile(); err != nil {
+		return err
+	}
+	// B+ 树索引中记录的活跃文件已经变化
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		return bpt.SaveMeta()
+	}
+	return nil
+}
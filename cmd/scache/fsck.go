@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sharch/scache"
+	"os"
+)
+
+// runFsck 离线检查数据目录的完整性，指定 -repair 时将有效的数据恢复到新的目录中
+// 用法：scache fsck [-repair <dest dir>] <dir>
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repairDir := flags.String("repair", "", "salvage every valid record into this directory")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: scache fsck [-repair <dest dir>] <dir>")
+		return 2
+	}
+	dirPath := flags.Arg(0)
+
+	var report *scache.VerifyReport
+	var err error
+	if *repairDir != "" {
+		report, err = scache.Repair(dirPath, *repairDir)
+	} else {
+		report, err = scache.Verify(dirPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return 1
+	}
+
+	for _, file := range report.Files {
+		fmt.Printf("%-20s size=%-12d records=%-10d valid=%d\n", file.FileName, file.Size, file.Records, file.ValidSize)
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("PROBLEM %s\n", problem)
+	}
+	if *repairDir != "" {
+		fmt.Printf("repaired data written to %s\n", *repairDir)
+	}
+	if !report.OK() {
+		fmt.Printf("%d problems found\n", len(report.Problems))
+		return 1
+	}
+	fmt.Println("no problems found")
+	return 0
+}
@@ -15,7 +15,7 @@ var db *scache.DB
 
 const version = "v0.0.1"
 
-func init() {
+func openDB() {
 	// 初始化 DB 实例
 	options := scache.DefaultOptions
 	err := os.MkdirAll("D:/code/scache/temp", 0777)
@@ -119,6 +119,17 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 }
 
 func main() {
+	// 子命令：离线检查数据目录
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(os.Args[2:]))
+	}
+	// 子命令：升级旧版本的数据目录
+	if len(os.Args) > 1 && os.Args[1] == "upgrade" {
+		os.Exit(runUpgrade(os.Args[2:]))
+	}
+
+	openDB()
+
 	// 注册处理方法
 	http.HandleFunc("/c/put", handlePut)
 	http.HandleFunc("/c/get", handleGet)
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sharch/scache"
+	"os"
+)
+
+// runUpgrade 将旧版本的数据目录升级为当前的文件格式
+// 用法：scache upgrade <dir>
+func runUpgrade(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: scache upgrade <dir>")
+		return 2
+	}
+	if err := scache.Upgrade(args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "upgrade failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s upgraded to file format version %d\n", args[0], scache.FileFormatVersion)
+	return 0
+}
@@ -0,0 +1,42 @@
+package scache
+
+import "github.com/sharch/scache/data"
+
+// 按照当前的压缩方式压缩 value，压缩之后没有变小时保存原始数据
+// 已经压缩过的数据不再处理，返回的是新的 LogRecord，不会修改传入的数据
+func (db *DB) compressLogRecord(logRecord *data.LogRecord) (*data.LogRecord, error) {
+	if db.options.Compression == NoCompression ||
+		logRecord.Compression != NoCompression ||
+		logRecord.Type != data.LogRecordNormal ||
+		len(logRecord.Value) < db.options.CompressionThreshold {
+		return logRecord, nil
+	}
+	compressor, ok := data.GetCompressor(db.options.Compression)
+	if !ok {
+		return nil, data.ErrUnknownCompression
+	}
+	value, err := compressor.Compress(logRecord.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) >= len(logRecord.Value) {
+		return logRecord, nil
+	}
+	compressed := *logRecord
+	compressed.Value = value
+	compressed.Compression = db.options.Compression
+	return &compressed, nil
+}
+
+// merge 时将 value 转换为当前的压缩方式，压缩方式不同的数据先解压再重新压缩
+func (db *DB) recompressLogRecord(logRecord *data.LogRecord) (*data.LogRecord, error) {
+	if logRecord.Compression != NoCompression && logRecord.Compression != db.options.Compression {
+		value, err := logRecord.DecodeValue()
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Value = value
+		logRecord.Compression = NoCompression
+	}
+	return db.compressLogRecord(logRecord)
+}
@@ -0,0 +1,29 @@
+package data
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// ChecksumType 记录的校验算法，保存在文件头中，同一个文件中的记录使用相同的算法
+type ChecksumType = byte
+
+const (
+	// ChecksumCRC32 CRC32 IEEE，没有文件头的文件总是使用这个算法
+	ChecksumCRC32 ChecksumType = iota
+
+	// ChecksumCRC32C CRC32 Castagnoli，在支持 SSE4.2 或者 ARMv8 CRC 指令的平台上有硬件加速
+	ChecksumCRC32C
+)
+
+var ErrUnknownChecksum = errors.New("unknown checksum type")
+
+var checksumTables = [...]*crc32.Table{
+	ChecksumCRC32:  crc32.IEEETable,
+	ChecksumCRC32C: crc32.MakeTable(crc32.Castagnoli),
+}
+
+// ValidChecksum 是否是支持的校验算法
+func ValidChecksum(typ ChecksumType) bool {
+	return int(typ) < len(checksumTables)
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType value 的压缩方式，保存在 LogRecord 头部 type 字节的高 4 位中
+type CompressionType = byte
+
+const (
+	// NoCompression 不压缩
+	NoCompression CompressionType = iota
+
+	// DeflateCompression 使用标准库的 DEFLATE 算法压缩
+	DeflateCompression
+)
+
+// 最多支持 16 种压缩方式
+const maxCompressionType CompressionType = 0x0f
+
+var ErrUnknownCompression = errors.New("unknown compression type, log record can not be decompressed")
+
+// Compressor 压缩算法，自定义的压缩算法需要通过 RegisterCompressor 注册
+type Compressor interface {
+	// Type 压缩方式，会记录到每条数据中，注册之后不能再修改
+	Type() CompressionType
+
+	// Compress 压缩数据
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress 解压数据
+	Decompress(src []byte) ([]byte, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	m map[CompressionType]Compressor
+}{m: map[CompressionType]Compressor{
+	DeflateCompression: &deflateCompressor{},
+}}
+
+// RegisterCompressor 注册自定义的压缩算法，压缩方式重复或者超出范围时 panic
+func RegisterCompressor(c Compressor) {
+	typ := c.Type()
+	if typ == NoCompression || typ > maxCompressionType {
+		panic(fmt.Sprintf("invalid compression type %d", typ))
+	}
+	compressors.Lock()
+	defer compressors.Unlock()
+	if _, ok := compressors.m[typ]; ok {
+		panic(fmt.Sprintf("compression type %d is already registered", typ))
+	}
+	compressors.m[typ] = c
+}
+
+// GetCompressor 根据压缩方式取出对应的压缩算法
+func GetCompressor(typ CompressionType) (Compressor, bool) {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	c, ok := compressors.m[typ]
+	return c, ok
+}
+
+// DecodeValue 返回解压之后的 value
+func (lr *LogRecord) DecodeValue() ([]byte, error) {
+	if lr.Compression == NoCompression {
+		return lr.Value, nil
+	}
+	c, ok := GetCompressor(lr.Compression)
+	if !ok {
+		return nil, ErrUnknownCompression
+	}
+	return c.Decompress(lr.Value)
+}
+
+// DEFLATE 压缩算法，复用压缩器避免每次重新分配内部的缓冲区
+type deflateCompressor struct {
+	writers sync.Pool
+}
+
+func (d *deflateCompressor) Type() CompressionType {
+	return DeflateCompression
+}
+
+func (d *deflateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := d.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	}
+	defer d.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *deflateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
@@ -6,7 +6,9 @@ import (
 	"github.com/sharch/scache/fio"
 	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
+	"sync"
 )
 
 var (
@@ -15,9 +17,11 @@ var (
 
 const (
 	DataFileNameSuffix    = ".data"
+	HintFileNameSuffix    = ".hint"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	IndexSnapshotFileName = "index-snapshot"
 )
 
 // DataFile 数据文件
@@ -25,51 +29,135 @@ type DataFile struct {
 	FileId    uint32        // 文件id
 	WriteOff  int64         // 文件写到了哪个位置
 	IoManager fio.IOManager // io 读写管理
+	Cipher    *Cipher       // 加密的记录使用的 Cipher，为空时无法读取加密的记录
+	Header    *FileHeader   // 文件头，为空表示文件没有文件头
+
+	preallocSize int64        // 使用可读写的内存文件映射时预先扩展的文件大小
+	ioLock       sync.RWMutex // 读取数据和替换 IoManager 互斥，快照和迭代器不持有数据库的锁读取数据
 }
 
-// OpenDataFile 打开新的数据文件
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+// OpenDataFile 打开新的数据文件，checksum 是新建文件时使用的校验算法，已有的文件使用文件头中记录的算法
+// preallocSize 是使用可读写的内存文件映射时预先扩展的文件大小，关闭文件时会截断到实际写入的大小
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType, checksum ChecksumType, preallocSize int64) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	return newDataFile(fileName, fileId, ioType, DataFileType, checksum, preallocSize)
 }
 
 // OpenHintFile 打开 Hint 索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(dirPath string, checksum ChecksumType) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fileName, 0, fio.StandardFIO, HintFileType, checksum, 0)
+}
+
+// OpenDataHintFile 打开单个数据文件对应的 hint 文件
+func OpenDataHintFile(dirPath string, fileId uint32, checksum ChecksumType) (*DataFile, error) {
+	return newDataFile(GetHintFileName(dirPath, fileId), fileId, fio.StandardFIO, HintFileType, checksum, 0)
 }
 
 // OpenMergeFinishedFile 打开标识 merge 完成的文件
 func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fileName, 0, fio.StandardFIO, 0, ChecksumCRC32, 0)
 }
 
 // OpenSeqNoFile 存储事务序列号的文件
 func OpenSeqNoFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fileName, 0, fio.StandardFIO, 0, ChecksumCRC32, 0)
 }
 
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
-func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+// OpenIndexSnapshotFile 打开内存索引快照文件
+func OpenIndexSnapshotFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, IndexSnapshotFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO, 0, ChecksumCRC32, 0)
+}
+
+// GetHintFileName 单个数据文件对应的 hint 文件名称
+func GetHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintFileNameSuffix)
+}
+
+// OpenFileReadOnly 以只读的方式打开文件，用于离线检查数据目录，不会创建文件或者写入文件头
+// typ 为 0 表示文件没有文件头，文件头无效或者没有写完整时返回错误
+func OpenFileReadOnly(fileName string, fileId uint32, typ FileType) (*DataFile, error) {
+	ioManager, err := fio.NewReadOnlyFileIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	dataFile := &DataFile{FileId: fileId, IoManager: ioManager}
+	if typ != 0 {
+		if dataFile.Header, err = readFileHeader(ioManager.Read, typ); err != nil {
+			_ = ioManager.Close()
+			return nil, err
+		}
+	}
+	if dataFile.WriteOff, err = ioManager.Size(); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// typ 为 0 表示文件没有文件头，只有数据文件和 hint 文件带有文件头
+func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType, typ FileType, checksum ChecksumType, preallocSize int64) (*DataFile, error) {
+	var header *FileHeader
+	if typ != 0 {
+		var err error
+		if header, err = initFileHeader(fileName, typ, fileId, checksum); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(fileName), err)
+		}
+	}
+
 	// 初始化 IOManager 管理器接口
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+	ioManager, err := fio.NewIOManager(fileName, ioType, preallocSize)
 	if err != nil {
 		return nil, err
 	}
-	return &DataFile{
-		FileId:    fileId,
-		WriteOff:  0,
-		IoManager: ioManager,
-	}, nil
+	dataFile := &DataFile{
+		FileId:       fileId,
+		IoManager:    ioManager,
+		Header:       header,
+		preallocSize: preallocSize,
+	}
+	dataFile.WriteOff = dataFile.HeaderSize()
+	return dataFile, nil
 }
 
-// ReadLogRecord 根据 offset 从数据文件中读取 LogRecord
+// HeaderSize 文件头的大小，也是第一条记录的位置
+func (df *DataFile) HeaderSize() int64 {
+	if df.Header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// Checksum 文件中的记录使用的校验算法
+func (df *DataFile) Checksum() ChecksumType {
+	if df.Header == nil {
+		return ChecksumCRC32
+	}
+	return df.Header.Checksum
+}
+
+// ReadLogRecord 根据 offset 从数据文件中读取 LogRecord，并校验 crc
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
+	return df.readLogRecord(offset, true)
+}
+
+// ReadLogRecordUnverified 根据 offset 从数据文件中读取 LogRecord，不校验 crc
+// 只能读取索引中记录的位置，不能用于识别文件末尾写入不完整的记录
+func (df *DataFile) ReadLogRecordUnverified(offset int64) (*LogRecord, int64, error) {
+	return df.readLogRecord(offset, false)
+}
+
+func (df *DataFile) readLogRecord(offset int64, verify bool) (*LogRecord, int64, error) {
+	df.ioLock.RLock()
+	defer df.ioLock.RUnlock()
+
 	fileSize, err := df.IoManager.Size()
 	if err != nil {
 		return nil, 0, err
@@ -99,11 +187,16 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 取出对应的 key 和 value 的长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	// 记录超出了文件的末尾，说明最后一条记录没有写完整
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire, Compression: header.compression}
 	// 开始读取用户实际存储的 key/value 数据
+	var kvBuf []byte
 	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+		kvBuf, err = df.readNBytes(keySize+valueSize, offset+headerSize)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -113,9 +206,18 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	// 校验数据的有效性
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+	if verify {
+		crc := getLogRecordCRC(df.Checksum(), logRecord, headerBuf[crc32.Size:headerSize])
+		if crc != header.crc {
+			return nil, 0, ErrInvalidCRC
+		}
+	}
+
+	// 解密 key 和 value
+	if header.encrypted {
+		if logRecord.Key, logRecord.Value, err = df.Cipher.decryptLogRecord(headerBuf[4], header, kvBuf); err != nil {
+			return nil, 0, err
+		}
 	}
 	return logRecord, recordSize, nil
 }
@@ -135,10 +237,24 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
 	}
-	encRecord, _ := EncodeLogRecord(record)
+	encRecord, _, err := df.Cipher.EncodeLogRecord(record, df.Checksum())
+	if err != nil {
+		return err
+	}
 	return df.Write(encRecord)
 }
 
+// EncodeHintRecord 编码单个数据文件的 hint 记录，保留原始的 key 和记录类型，cipher 不为空时加密
+func EncodeHintRecord(cipher *Cipher, checksum ChecksumType, key []byte, typ LogRecordType, pos *LogRecordPos) ([]byte, error) {
+	record := &LogRecord{
+		Key:   key,
+		Value: EncodeLogRecordPos(pos),
+		Type:  typ,
+	}
+	encRecord, _, err := cipher.EncodeLogRecord(record, checksum)
+	return encRecord, err
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
@@ -148,10 +264,13 @@ func (df *DataFile) Close() error {
 }
 
 func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
+	df.ioLock.Lock()
+	defer df.ioLock.Unlock()
+
 	if err := df.IoManager.Close(); err != nil {
 		return err
 	}
-	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType)
+	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType, df.preallocSize)
 	if err != nil {
 		return err
 	}
@@ -159,6 +278,33 @@ func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
 	return nil
 }
 
+// Truncate 将数据文件截断到指定的大小，并使用指定的 IO 类型重新打开
+// 重新打开期间等待正在进行的读取完成，之后的读取使用新的 IoManager
+func (df *DataFile) Truncate(dirPath string, size int64, ioType fio.FileIOType) error {
+	df.ioLock.Lock()
+	defer df.ioLock.Unlock()
+
+	if err := df.IoManager.Close(); err != nil {
+		return err
+	}
+	if err := os.Truncate(GetDataFileName(dirPath, df.FileId), size); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewIOManager(GetDataFileName(dirPath, df.FileId), ioType, df.preallocSize)
+	if err != nil {
+		return err
+	}
+	df.IoManager = ioManager
+	df.WriteOff = size
+	return nil
+}
+
+// Seal 活跃文件写满之后转换为旧的数据文件，截断预先扩展的部分，并使用指定的 IO 类型重新打开
+func (df *DataFile) Seal(dirPath string, ioType fio.FileIOType) error {
+	df.preallocSize = 0
+	return df.Truncate(dirPath, df.WriteOff, ioType)
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
 	_, err = df.IoManager.Read(b, offset)
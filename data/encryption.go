@@ -0,0 +1,178 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrEncryptedRecord   = errors.New("log record is encrypted, a key provider is required")
+	ErrInvalidCiphertext = errors.New("invalid ciphertext, data maybe corrupted or the key is wrong")
+)
+
+// KeyProvider 提供加密使用的密钥，密钥的长度必须是 16、24 或者 32 字节
+type KeyProvider interface {
+	// CurrentKey 返回当前用于加密新数据的密钥和对应的 id
+	CurrentKey() (uint32, []byte, error)
+
+	// Key 根据 id 返回对应的密钥，轮换之后旧的密钥仍然需要保留，直到 merge 用新的密钥重写了所有的数据
+	Key(id uint32) ([]byte, error)
+}
+
+// Cipher 使用 AES-GCM 加密数据，密文中记录了加密使用的密钥 id，轮换密钥之后旧的数据仍然可以解密
+type Cipher struct {
+	provider KeyProvider
+	mu       *sync.RWMutex
+	aeads    map[uint32]cipher.AEAD
+}
+
+// NewCipher 根据密钥提供者初始化 Cipher
+func NewCipher(provider KeyProvider) *Cipher {
+	return &Cipher{
+		provider: provider,
+		mu:       new(sync.RWMutex),
+		aeads:    make(map[uint32]cipher.AEAD),
+	}
+}
+
+// Encrypt 使用当前的密钥加密数据，additionalData 参与认证但不会被加密
+//
+//	+-------------+-------------+-------------+
+//	|   密钥 id   |    nonce    |     密文     |
+//	+-------------+-------------+-------------+
+//	  变长（最大5）     12字节      数据长度+16字节
+func (c *Cipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	id, key, err := c.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, binary.MaxVarintLen32+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	buf = binary.AppendUvarint(buf, uint64(id))
+	nonceStart := len(buf)
+	buf = buf[:nonceStart+aead.NonceSize()]
+	if _, err := rand.Read(buf[nonceStart:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf[nonceStart:], plaintext, additionalData), nil
+}
+
+// Decrypt 根据密文中记录的密钥 id 解密数据
+func (c *Cipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	id, n := binary.Uvarint(ciphertext)
+	if n <= 0 {
+		return nil, ErrInvalidCiphertext
+	}
+	aead, err := c.aead(uint32(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[n:]
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+// CurrentKeyId 当前用于加密新数据的密钥 id
+func (c *Cipher) CurrentKeyId() (uint32, error) {
+	id, _, err := c.provider.CurrentKey()
+	return id, err
+}
+
+// DeriveKey 根据密钥 id 派生出用于其他用途的子密钥，不直接复用加密数据的密钥
+func (c *Cipher) DeriveKey(id uint32, purpose string) ([]byte, error) {
+	key, err := c.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil), nil
+}
+
+// 取出密钥 id 对应的 AEAD，key 为空时从密钥提供者中获取
+func (c *Cipher) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	c.mu.RLock()
+	aead, ok := c.aeads[id]
+	c.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = c.provider.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.aeads[id] = aead
+	c.mu.Unlock()
+	return aead, nil
+}
+
+// EncodeLogRecord 使用指定的校验算法对 LogRecord 进行编码，并加密其中的 key 和 value，cipher 为空时不加密
+func (c *Cipher) EncodeLogRecord(logRecord *LogRecord, checksum ChecksumType) ([]byte, int64, error) {
+	if c == nil {
+		encRecord, size := EncodeLogRecordWithChecksum(logRecord, checksum)
+		return encRecord, size, nil
+	}
+
+	typ := logRecord.Type | logRecordEncryptedFlag | logRecord.Compression<<4
+	plaintext := make([]byte, len(logRecord.Key)+len(logRecord.Value))
+	copy(plaintext, logRecord.Key)
+	copy(plaintext[len(logRecord.Key):], logRecord.Value)
+	payload, err := c.Encrypt(plaintext, logRecordAdditionalData(typ, int64(len(logRecord.Key)), logRecord.Expire))
+	if err != nil {
+		return nil, 0, err
+	}
+	encRecord, size := encodeLogRecord(checksum, typ, int64(len(logRecord.Key)), logRecord.Expire, payload)
+	return encRecord, size, nil
+}
+
+// 解密 key 和 value
+func (c *Cipher) decryptLogRecord(typ byte, header *logRecordHeader, payload []byte) ([]byte, []byte, error) {
+	if c == nil {
+		return nil, nil, ErrEncryptedRecord
+	}
+	plaintext, err := c.Decrypt(payload, logRecordAdditionalData(typ, int64(header.keySize), header.expire))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) < int(header.keySize) {
+		return nil, nil, ErrInvalidCiphertext
+	}
+	return plaintext[:header.keySize], plaintext[header.keySize:], nil
+}
+
+// 加密 LogRecord 时参与认证的头部信息
+func logRecordAdditionalData(typ byte, keySize int64, expire int64) []byte {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64*2)
+	buf[0] = typ
+	buf = binary.AppendVarint(buf, keySize)
+	buf = binary.AppendVarint(buf, expire)
+	return buf
+}
@@ -0,0 +1,150 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/sharch/scache/fio"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// FileType 带有文件头的文件类型
+type FileType = byte
+
+const (
+	// DataFileType 数据文件
+	DataFileType FileType = iota + 1
+
+	// HintFileType hint 索引文件，包括 merge 生成的 hint 文件和单个数据文件的 hint 文件
+	HintFileType
+)
+
+// FileFormatVersion 当前的文件格式版本，LogRecord 的编码方式发生不兼容的变化时需要升级版本
+const FileFormatVersion uint16 = 1
+
+// FileHeaderSize 文件头的大小，第一条记录从文件头之后开始
+//
+//	+---------+---------+---------+---------+---------+-----------+---------+---------+
+//	|  magic  | version |  type   | 校验算法 | file id | create at | 保留字段 |   crc   |
+//	+---------+---------+---------+---------+---------+-----------+---------+---------+
+//	   4字节      2字节     1字节     1字节      4字节       8字节        8字节     4字节
+const FileHeaderSize = 32
+
+var fileHeaderMagic = []byte("SCDB")
+
+var (
+	ErrLegacyFileFormat       = errors.New("the file has no format header, upgrade the legacy data directory first")
+	ErrUnsupportedFileVersion = errors.New("unsupported file format version")
+	ErrInvalidFileHeader      = errors.New("invalid file header, file maybe corrupted")
+	ErrIncompleteFileHeader   = errors.New("incomplete file header")
+)
+
+// FileHeader 数据文件和 hint 文件的文件头
+type FileHeader struct {
+	Version   uint16       // 文件格式版本
+	Type      FileType     // 文件类型
+	Checksum  ChecksumType // 文件中的记录使用的校验算法
+	FileId    uint32       // 创建时的文件 id
+	CreatedAt int64        // 创建时间，UnixNano 时间戳
+}
+
+// EncodeFileHeader 对文件头进行编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf, fileHeaderMagic)
+	binary.LittleEndian.PutUint16(buf[4:], header.Version)
+	buf[6] = header.Type
+	buf[7] = header.Checksum
+	binary.LittleEndian.PutUint32(buf[8:], header.FileId)
+	binary.LittleEndian.PutUint64(buf[12:], uint64(header.CreatedAt))
+	binary.LittleEndian.PutUint32(buf[FileHeaderSize-crc32.Size:], crc32.ChecksumIEEE(buf[:FileHeaderSize-crc32.Size]))
+	return buf
+}
+
+// DecodeFileHeader 解码文件头，没有 magic 的文件是旧格式的文件
+func DecodeFileHeader(buf []byte) (*FileHeader, error) {
+	if len(buf) < FileHeaderSize || !bytes.Equal(buf[:len(fileHeaderMagic)], fileHeaderMagic) {
+		return nil, ErrLegacyFileFormat
+	}
+	crc := binary.LittleEndian.Uint32(buf[FileHeaderSize-crc32.Size:])
+	if crc != crc32.ChecksumIEEE(buf[:FileHeaderSize-crc32.Size]) {
+		return nil, ErrInvalidFileHeader
+	}
+	header := &FileHeader{
+		Version:   binary.LittleEndian.Uint16(buf[4:]),
+		Type:      buf[6],
+		Checksum:  buf[7],
+		FileId:    binary.LittleEndian.Uint32(buf[8:]),
+		CreatedAt: int64(binary.LittleEndian.Uint64(buf[12:])),
+	}
+	if header.Version != FileFormatVersion {
+		return nil, ErrUnsupportedFileVersion
+	}
+	if !ValidChecksum(header.Checksum) {
+		return nil, ErrUnknownChecksum
+	}
+	return header, nil
+}
+
+// NewFileHeader 新建文件使用的文件头
+func NewFileHeader(typ FileType, fileId uint32, checksum ChecksumType) *FileHeader {
+	return &FileHeader{
+		Version:   FileFormatVersion,
+		Type:      typ,
+		Checksum:  checksum,
+		FileId:    fileId,
+		CreatedAt: time.Now().UnixNano(),
+	}
+}
+
+// 读取文件头，文件头没有写完整时返回 ErrIncompleteFileHeader，readAt 需要和 io.ReaderAt 的语义一致
+func readFileHeader(readAt func(b []byte, offset int64) (int, error), typ FileType) (*FileHeader, error) {
+	buf := make([]byte, FileHeaderSize)
+	n, err := readAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// 创建文件时的崩溃可能导致文件头没有写完整，此时文件中不会有任何记录
+	prefix := buf[:n]
+	if n > len(fileHeaderMagic) {
+		prefix = buf[:len(fileHeaderMagic)]
+	}
+	if n < FileHeaderSize && bytes.HasPrefix(fileHeaderMagic, prefix) {
+		return nil, ErrIncompleteFileHeader
+	}
+	header, err := DecodeFileHeader(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != typ {
+		return nil, ErrInvalidFileHeader
+	}
+	return header, nil
+}
+
+// 读取文件头，空文件或者文件头没有写完整时使用指定的校验算法写入新的文件头
+func initFileHeader(fileName string, typ FileType, fileId uint32, checksum ChecksumType) (*FileHeader, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, fio.DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	header, err := readFileHeader(file.ReadAt, typ)
+	if err != ErrIncompleteFileHeader {
+		return header, err
+	}
+	header = NewFileHeader(typ, fileId, checksum)
+	if err := file.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteAt(EncodeFileHeader(header), 0); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
@@ -0,0 +1,77 @@
+package data
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// 旧版本的记录头部：crc type keySize valueSize
+// 4 +  1  +  5   +   5 = 15
+const maxLegacyLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+
+// ReadLegacyLogRecord 按照没有文件头的旧版本格式读取 offset 处的 LogRecord，只用于升级旧版本的数据目录
+// 旧版本的头部没有过期时间，type 字节中只有记录类型，总是使用 CRC32 校验
+//
+//	+-------------+-------------+-------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+func ReadLegacyLogRecord(r io.ReaderAt, offset int64, fileSize int64) (*LogRecord, int64, error) {
+	var headerBytes int64 = maxLegacyLogRecordHeaderSize
+	if offset+headerBytes > fileSize {
+		headerBytes = fileSize - offset
+	}
+	if headerBytes <= crc32.Size {
+		return nil, 0, io.EOF
+	}
+	headerBuf := make([]byte, headerBytes)
+	if _, err := r.ReadAt(headerBuf, offset); err != nil {
+		return nil, 0, err
+	}
+
+	crc := binary.LittleEndian.Uint32(headerBuf[:4])
+	var index = 5
+	keySize, n := binary.Varint(headerBuf[index:])
+	if n <= 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	index += n
+	valueSize, n := binary.Varint(headerBuf[index:])
+	if n <= 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	index += n
+
+	// 和当前的格式一样，全 0 的数据表示读取到了文件末尾
+	if crc == 0 && keySize == 0 && valueSize == 0 {
+		return nil, 0, io.EOF
+	}
+	if keySize < 0 || valueSize < 0 {
+		return nil, 0, ErrInvalidCRC
+	}
+	var recordSize = int64(index) + keySize + valueSize
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	kvBuf := make([]byte, keySize+valueSize)
+	if _, err := r.ReadAt(kvBuf, offset+int64(index)); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Update(crc32.ChecksumIEEE(headerBuf[4:index]), crc32.IEEETable, kvBuf) != crc {
+		return nil, 0, ErrInvalidCRC
+	}
+	return &LogRecord{
+		Key:   kvBuf[:keySize],
+		Value: kvBuf[keySize:],
+		Type:  headerBuf[4],
+	}, recordSize, nil
+}
+
+// LegacyLogRecordSize 记录按照旧版本格式编码之后的大小，用于计算升级之前的记录位置
+func LegacyLogRecordSize(logRecord *LogRecord) int64 {
+	buf := make([]byte, binary.MaxVarintLen32)
+	size := 5 + binary.PutVarint(buf, int64(len(logRecord.Key))) + binary.PutVarint(buf, int64(len(logRecord.Value)))
+	return int64(size + len(logRecord.Key) + len(logRecord.Value))
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"time"
 )
 
 type LogRecordType = byte
@@ -13,24 +14,36 @@ const (
 	LogRecordTxnFinished
 )
 
-// crc type keySize valueSize
-// 4 +  1  +  5   +   5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// 头部 type 字节的低 3 位是 LogRecord 的类型，第 4 位标识 key 和 value 是否加密，高 4 位是 value 的压缩方式
+const (
+	logRecordTypeMask      = 0x07
+	logRecordEncryptedFlag = 0x08
+)
+
+// crc type keySize valueSize expire
+// 4 +  1  +  5   +   5   +   10 = 25
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 
 // LogRecord 写入到数据文件的记录
 // 之所以叫日志，是因为数据文件中的数据是追加写入的，类似日志的格式
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64 // 过期时间，UnixNano 时间戳，0 表示永不过期
+	// value 的压缩方式，Value 中保存的是压缩之后的数据，通过 DecodeValue 取出原始数据
+	Compression CompressionType
 }
 
 // LogRecord 的头部信息
 type logRecordHeader struct {
-	crc        uint32        // crc 校验值
-	recordType LogRecordType // 标识 LogRecord 的类型
-	keySize    uint32        // key 的长度
-	valueSize  uint32        // value 的长度
+	crc         uint32          // crc 校验值
+	recordType  LogRecordType   // 标识 LogRecord 的类型
+	encrypted   bool            // key 和 value 是否加密
+	compression CompressionType // value 的压缩方式
+	keySize     uint32          // key 的长度
+	valueSize   uint32          // value 的长度
+	expire      int64           // 过期时间
 }
 
 // LogRecordPos 数据内存索引，主要是描述数据在磁盘上的位置
@@ -38,6 +51,7 @@ type LogRecordPos struct {
 	Fid    uint32 // 文件 id，表示将数据存储到了哪个文件当中
 	Offset int64  // 偏移，表示将数据存储到了数据文件中的哪个位置
 	Size   uint32 // 标识数据在磁盘上的大小
+	Expire int64  // 过期时间，0 表示永不过期
 }
 
 // TransactionRecord 暂存的事务相关的数据
@@ -48,45 +62,65 @@ type TransactionRecord struct {
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |    expire    |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）   变长（最大10）     变长           变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	return EncodeLogRecordWithChecksum(logRecord, ChecksumCRC32)
+}
+
+// EncodeLogRecordWithChecksum 使用指定的校验算法对 LogRecord 进行编码，校验算法需要和写入的文件一致
+func EncodeLogRecordWithChecksum(logRecord *LogRecord, checksum ChecksumType) ([]byte, int64) {
+	typ := logRecord.Type | logRecord.Compression<<4
+	return encodeLogRecord(checksum, typ, int64(len(logRecord.Key)), logRecord.Expire, logRecord.Key, logRecord.Value)
+}
+
+// 按照 LogRecord 的格式编码，body 依次拼接在 header 之后，除去 key 的部分都记为 value
+func encodeLogRecord(checksum ChecksumType, typ byte, keySize int64, expire int64, body ...[]byte) ([]byte, int64) {
+	var bodySize int64
+	for _, b := range body {
+		bodySize += int64(len(b))
+	}
+
 	// 初始化一个 header 部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 
-	// 第五个字节存储 Type
-	header[4] = logRecord.Type
+	// 第五个字节存储 Type、加密标识和压缩方式
+	header[4] = typ
 	var index = 5
 	// 5 字节之后，存储的是 key 和 value 的长度信息
 	// 使用变长类型，节省空间
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	index += binary.PutVarint(header[index:], keySize)
+	index += binary.PutVarint(header[index:], bodySize-keySize)
+	index += binary.PutVarint(header[index:], expire)
 
-	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	var size = int64(index) + bodySize
 	encBytes := make([]byte, size)
 
 	// 将 header 部分的内容拷贝过来
 	copy(encBytes[:index], header[:index])
 	// 将 key 和 value 数据拷贝到字节数组中
-	copy(encBytes[index:], logRecord.Key)
-	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
+	offset := index
+	for _, b := range body {
+		offset += copy(encBytes[offset:], b)
+	}
 
 	// 对整个 LogRecord 的数据进行 crc 校验
-	crc := crc32.ChecksumIEEE(encBytes[4:])
+	crc := crc32.Checksum(encBytes[4:], checksumTables[checksum])
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
 
-	return encBytes, int64(size)
+	return encBytes, size
 }
 
 // EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	index += binary.PutVarint(buf[index:], pos.Expire)
 	return buf[:index]
 }
 
@@ -97,8 +131,28 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
-	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	size, n := binary.Varint(buf[index:])
+	index += n
+	// 兼容没有过期时间的旧格式
+	var expire int64
+	if index < len(buf) {
+		expire, _ = binary.Varint(buf[index:])
+	}
+	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size), Expire: expire}
+}
+
+// IsExpired 判断数据是否已经过期
+func (lr *LogRecord) IsExpired() bool {
+	return isExpired(lr.Expire)
+}
+
+// IsExpired 判断索引指向的数据是否已经过期
+func (pos *LogRecordPos) IsExpired() bool {
+	return isExpired(pos.Expire)
+}
+
+func isExpired(expire int64) bool {
+	return expire > 0 && expire <= time.Now().UnixNano()
 }
 
 // 对字节数组中的 Header 信息进行解码
@@ -108,8 +162,10 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	}
 
 	header := &logRecordHeader{
-		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		crc:         binary.LittleEndian.Uint32(buf[:4]),
+		recordType:  buf[4] & logRecordTypeMask,
+		encrypted:   buf[4]&logRecordEncryptedFlag != 0,
+		compression: buf[4] >> 4,
 	}
 
 	var index = 5
@@ -123,17 +179,23 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// 取出过期时间
+	expire, n := binary.Varint(buf[index:])
+	header.expire = expire
+	index += n
+
 	return header, int64(index)
 }
 
-func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
+func getLogRecordCRC(checksum ChecksumType, lr *LogRecord, header []byte) uint32 {
 	if lr == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
+	table := checksumTables[checksum]
+	crc := crc32.Checksum(header[:], table)
+	crc = crc32.Update(crc, table, lr.Key)
+	crc = crc32.Update(crc, table, lr.Value)
 
 	return crc
 }
@@ -1,6 +1,11 @@
 package data
 
-import "testing"
+import (
+	"bytes"
+	"github.com/sharch/scache/fio"
+	"strings"
+	"testing"
+)
 
 func TestEncodeLogRecord(t *testing.T) {
 	log1 := &LogRecord{
@@ -20,6 +25,140 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 		Type:  LogRecordNormal,
 	}
 	res1, _ := EncodeLogRecord(log1)
-	header, _ := parseHeader(res1)
+	header, _ := decodeLogRecordHeader(res1)
 	t.Log(header)
 }
+
+func TestEncodeLogRecordWithExpire(t *testing.T) {
+	log1 := &LogRecord{
+		Key:    []byte("test1"),
+		Value:  []byte("value1"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res1, _ := EncodeLogRecord(log1)
+	header, _ := decodeLogRecordHeader(res1)
+	if header.expire != log1.Expire {
+		t.Fatalf("expire mismatch, got %d, want %d", header.expire, log1.Expire)
+	}
+
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20, Expire: log1.Expire}
+	decPos := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	if *decPos != *pos {
+		t.Fatalf("pos mismatch, got %v, want %v", decPos, pos)
+	}
+}
+
+func TestEncodeLogRecordWithCompression(t *testing.T) {
+	compressor, ok := GetCompressor(DeflateCompression)
+	if !ok {
+		t.Fatal("deflate compressor not registered")
+	}
+	value := []byte(strings.Repeat(`{"name":"scache","type":"kv"}`, 20))
+	compressed, err := compressor.Compress(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log1 := &LogRecord{
+		Key:         []byte("test1"),
+		Value:       compressed,
+		Type:        LogRecordDeleted,
+		Compression: DeflateCompression,
+	}
+	res1, _ := EncodeLogRecord(log1)
+	header, _ := decodeLogRecordHeader(res1)
+	if header.recordType != LogRecordDeleted || header.compression != DeflateCompression {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	decoded, err := log1.DecodeValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != string(value) {
+		t.Fatalf("value mismatch after decompress")
+	}
+}
+
+type testKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (p *testKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *testKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrInvalidCiphertext
+	}
+	return key, nil
+}
+
+func TestEncryptLogRecord(t *testing.T) {
+	provider := &testKeyProvider{current: 1, keys: map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 32),
+	}}
+	dataFile, err := OpenDataFile(t.TempDir(), 0, fio.StandardFIO, ChecksumCRC32C, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataFile.Close()
+	dataFile.Cipher = NewCipher(provider)
+
+	log1 := &LogRecord{Key: []byte("test1"), Value: []byte("value1"), Type: LogRecordNormal, Expire: 1700000000000000000}
+	res1, size1, err := dataFile.Cipher.EncodeLogRecord(log1, dataFile.Checksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(res1, log1.Key) || bytes.Contains(res1, log1.Value) {
+		t.Fatal("plaintext found in encrypted record")
+	}
+	// 轮换密钥之后旧的数据仍然可以解密
+	provider.current = 2
+	log2 := &LogRecord{Key: []byte("test2"), Value: []byte("value2"), Type: LogRecordDeleted}
+	res2, _, err := dataFile.Cipher.EncodeLogRecord(log2, dataFile.Checksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dataFile.Write(append(res1, res2...)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := dataFile.HeaderSize()
+	for i, offset := range []int64{start, start + size1} {
+		record, _, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []*LogRecord{log1, log2}[i]
+		if string(record.Key) != string(want.Key) || string(record.Value) != string(want.Value) ||
+			record.Type != want.Type || record.Expire != want.Expire {
+			t.Fatalf("record mismatch, got %+v, want %+v", record, want)
+		}
+	}
+
+	dataFile.Cipher = nil
+	if _, _, err := dataFile.ReadLogRecord(start); err != ErrEncryptedRecord {
+		t.Fatalf("expected ErrEncryptedRecord, got %v", err)
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+	header := NewFileHeader(HintFileType, 7, ChecksumCRC32C)
+	decoded, err := DecodeFileHeader(EncodeFileHeader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *header {
+		t.Fatalf("header mismatch, got %+v, want %+v", decoded, header)
+	}
+
+	record, _ := EncodeLogRecord(&LogRecord{Key: []byte("test1"), Value: []byte("value1")})
+	if _, err := DecodeFileHeader(append(record, make([]byte, FileHeaderSize)...)); err != ErrLegacyFileFormat {
+		t.Fatalf("expected ErrLegacyFileFormat, got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package scache
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gofrs/flock"
@@ -9,42 +11,85 @@ import (
 	"github.com/sharch/scache/index"
 	"github.com/sharch/scache/utils"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
 	seqNoKey     = "seq.no"
 	fileLockName = "flock"
+
+	// 累计写入多少字节之后重新获取磁盘剩余空间
+	diskCheckBytes = 4 * 1024 * 1024
 )
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
-	activeFile      *data.DataFile            // 当前活跃数据文件，可以用于写入
-	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index           index.Indexer             // 内存索引
-	seqNo           uint64                    // 事务序列号，全局递增
-	isMerging       bool                      // 是否正在 merge
-	seqNoFileExists bool                      // 存储事务序列号的文件是否存在
-	isInitial       bool                      // 是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              // 文件锁保证多进程之间的互斥
-	bytesWrite      uint                      // 累计写了多少个字节
-	reclaimSize     int64                     // 表示有多少数据是无效的
+	options            Options
+	mu                 *sync.RWMutex
+	fileIds            []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
+	activeFile         *data.DataFile            // 当前活跃数据文件，可以用于写入
+	olderFiles         map[uint32]*data.DataFile // 旧的数据文件，只能用于读
+	index              index.Indexer             // 内存索引
+	cipher             *data.Cipher              // 加密数据使用的 Cipher，为空表示不加密
+	seqNo              uint64                    // 事务序列号，全局递增，每次写入都会递增
+	isMerging          bool                      // 是否正在 merge
+	mergeInstallFailed bool                      // merge 之后的文件没有完整移动到数据目录中，重新打开之前不能再次 merge
+	seqNoFileExists    bool                      // 是否从 seq-no 文件或者 B+ 树索引中恢复了事务序列号
+	isInitial          bool                      // 是否是第一次初始化此数据目录
+	fileLock           *flock.Flock              // 文件锁保证多进程之间的互斥
+	bytesWrite         uint                      // 累计写了多少个字节
+	reclaimSize        int64                     // 表示有多少数据是无效的
+	fileReclaimSize    map[uint32]int64          // 每个数据文件中有多少数据是无效的
+	refMu              *sync.Mutex               // 保护数据文件的引用计数，持有读锁时也可以引用数据文件
+	fileGen            uint64                    // 数据文件集合的版本，merge 替换文件或者活跃文件写满之后递增
+	fileRefs           map[uint64]int64          // 每个版本的数据文件集合被快照、迭代器和 merge 引用的次数
+	retiredFiles       []*staleFile              // merge 之后被替换的旧数据文件，引用对应版本的读取都释放之后再关闭
+	sealedFiles        []*staleFile              // 写满之后还没有截断和重新打开的活跃文件，引用对应版本的读取都释放之后再处理
+	snapshots          map[*Snapshot]struct{}    // 当前未释放的快照，包括读写事务使用的快照
+	keyVersions        map[string][]*keyVersion  // 存在快照时，记录 key 每次被修改之前的位置信息，用于读取快照和冲突检测
+	autoMergeCancel    context.CancelFunc        // 通知后台自动 merge 协程退出
+	autoMergeDone      chan struct{}             // 后台自动 merge 协程已经退出
+	commitMu           *sync.Mutex               // 保护组提交的等待队列
+	commitQueue        []*commitRequest          // 等待组提交的写入
+	committing         bool                      // 是否有写入正在作为 leader 进行组提交
+	activeHint         []byte                    // 当前活跃文件中所有记录编码之后的 hint 记录，文件写满之后写到 hint 文件中
+	indexRebuildNeeded bool                      // 打开时发现 B+ 树索引缺失、损坏或者落后于数据文件，需要重建
+	readOnly           bool                      // 磁盘空间不足时切换为只读模式，拒绝所有的写入
+	diskAvailable      uint64                    // 最近一次获取的磁盘剩余空间大小
+	diskWritten        uint64                    // 最近一次获取磁盘剩余空间之后写入的字节数
 }
 
 // Stat 存储引擎统计信息
 type Stat struct {
-	KeyNum          uint  // key 的总数量
-	DataFileNum     uint  // 数据文件的数量
-	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
-	DiskSize        int64 // 数据目录所占磁盘空间大小
+	KeyNum          uint            // key 的总数量
+	DataFileNum     uint            // 数据文件的数量
+	ReclaimableSize int64           // 可以进行 merge 回收的数据量，字节为单位
+	DiskSize        int64           // 数据目录所占磁盘空间大小
+	DataFiles       []*DataFileStat // 每个数据文件的统计信息，按照文件 id 从小到大排序
+	ReadOnly        bool            // 是否因为磁盘空间不足处于只读模式
+}
+
+// DataFileStat 单个数据文件的统计信息
+type DataFileStat struct {
+	FileId          uint32 // 文件 id
+	Size            int64  // 文件大小
+	LiveSize        int64  // 有效的数据量
+	ReclaimableSize int64  // 可以回收的数据量
+}
+
+// 等待引用释放之后再关闭或者重新打开的数据文件
+type staleFile struct {
+	file *data.DataFile
+	gen  uint64 // 文件最后所在的数据文件集合的版本，引用这个版本及之前版本的读取都释放之后才能处理
 }
 
 // Open 打开 bitcask 存储引擎实例
@@ -83,59 +128,171 @@ func Open(options Options) (*DB, error) {
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		options:         options,
+		mu:              new(sync.RWMutex),
+		commitMu:        new(sync.Mutex),
+		refMu:           new(sync.Mutex),
+		fileRefs:        make(map[uint64]int64),
+		olderFiles:      make(map[uint32]*data.DataFile),
+		fileReclaimSize: make(map[uint32]int64),
+		snapshots:       make(map[*Snapshot]struct{}),
+		keyVersions:     make(map[string][]*keyVersion),
+		isInitial:       isInitial,
+		fileLock:        fileLock,
+	}
+
+	if options.KeyProvider != nil {
+		db.cipher = data.NewCipher(options.KeyProvider)
+	}
+
+	// 加载数据文件和索引，失败时释放已经打开的资源
+	if err := db.load(); err != nil {
+		db.closeOnOpenFailure()
+		return nil, err
+	}
+	if err := db.switchActiveFileChecksum(); err != nil {
+		db.closeOnOpenFailure()
+		return nil, err
+	}
+
+	// 启动后台自动 merge
+	if options.AutoMergeInterval > 0 {
+		db.startAutoMerge()
+	}
+
+	return db, nil
+}
+
+// 加载数据文件，并构建内存索引
+func (db *DB) load() error {
+	// 打开索引
+	if err := db.openIndex(); err != nil {
+		return err
 	}
 
 	// 加载 merge 数据目录
 	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// 加载数据文件
 	if err := db.loadDataFiles(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// B+树索引不需要从数据文件中加载索引
-	if options.IndexType != BPlusTree {
+	if db.options.IndexType != BPlusTree {
+		// 优先从内存索引快照中加载，只需要读取快照之后写入的数据
+		var startFileId uint32
+		var startOffset int64
+		var fromSnapshot bool
+		if db.indexSnapshotEnabled() {
+			startFileId, startOffset, fromSnapshot = db.loadIndexSnapshot()
+		}
+
 		// 从 hint 索引文件中加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, err
+		if !fromSnapshot {
+			if err := db.loadIndexFromHintFile(); err != nil {
+				return err
+			}
 		}
 
 		// 从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(); err != nil {
-			return nil, err
+		if err := db.loadIndexFromDataFiles(startFileId, startOffset); err != nil {
+			return err
 		}
 
-		// 重置 IO 类型为标准文件 IO
+		// 重置为配置的 IO 类型
 		if db.options.MMapAtStartup {
 			if err := db.resetIoType(); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	// 取出当前事务序列号
-	if options.IndexType == BPlusTree {
+	// 取出当前事务序列号，B+ 树索引落后于数据文件时从数据文件中重建索引
+	if db.options.IndexType == BPlusTree {
 		if err := db.loadSeqNo(); err != nil {
-			return nil, err
+			return err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
-			if err != nil {
-				return nil, err
+		if err := db.loadIndexMeta(); err != nil {
+			return err
+		}
+		if db.options.MMapAtStartup {
+			if err := db.resetIoType(); err != nil {
+				return err
 			}
+		}
+	}
+	return nil
+}
+
+// 从 B+ 树索引中恢复事务序列号和活跃文件的写入位置，之后每次更新索引时都会一起持久化
+// 即使没有正常关闭数据库，也可以从索引中恢复事务序列号
+func (db *DB) loadIndexMeta() error {
+	bpt, ok := db.index.(*index.BPlusTree)
+	if !ok {
+		return nil
+	}
+	meta, err := bpt.Meta()
+	if err != nil {
+		log.Printf("invalid bptree index meta: %v\n", err)
+		db.indexRebuildNeeded = true
+	}
+	if meta != nil {
+		if meta.SeqNo > db.seqNo {
+			db.seqNo = meta.SeqNo
+		}
+		db.seqNoFileExists = true
+	}
+
+	if db.activeFile != nil && !db.indexRebuildNeeded {
+		size, err := db.activeFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		if meta != nil && meta.FileId == db.activeFile.FileId && meta.WriteOff == size {
+			// 活跃文件在最后一次更新索引之后没有写入过数据，不需要重新读取
 			db.activeFile.WriteOff = size
+		} else if meta != nil {
+			// 索引记录的位置和数据文件不一致，说明有数据没有更新到索引中
+			log.Printf("bptree index is behind the data files (file %d offset %d)\n", meta.FileId, meta.WriteOff)
+			db.indexRebuildNeeded = true
+		} else if err := db.loadActiveFileWriteOff(); err != nil {
+			return err
 		}
 	}
 
-	return db, nil
+	if db.indexRebuildNeeded && db.activeFile != nil {
+		return db.rebuildIndex()
+	}
+	bpt.SetMetaProvider(db.indexMeta)
+	return nil
+}
+
+// 需要和 B+ 树索引一起持久化的元信息
+// 在访问此方法前必须持有互斥锁
+func (db *DB) indexMeta() *index.IndexMeta {
+	meta := &index.IndexMeta{SeqNo: atomic.LoadUint64(&db.seqNo)}
+	if db.activeFile != nil {
+		meta.FileId = db.activeFile.FileId
+		meta.WriteOff = db.activeFile.WriteOff
+	}
+	return meta
+}
+
+// 打开数据库失败时关闭已经打开的文件和索引，并释放文件锁
+func (db *DB) closeOnOpenFailure() {
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	if db.index != nil {
+		_ = db.index.Close()
+	}
+	_ = db.fileLock.Unlock()
 }
 
 // Close 关闭数据库
@@ -150,6 +307,9 @@ func (db *DB) Close() error {
 			panic(fmt.Sprintf("failed to close index"))
 		}
 	}()
+	// 停止后台自动 merge
+	db.stopAutoMerge()
+
 	if db.activeFile == nil {
 		return nil
 	}
@@ -173,6 +333,19 @@ func (db *DB) Close() error {
 		return err
 	}
 
+	// 为当前活跃文件写 hint 文件，保存内存索引快照，加快下次启动的速度
+	db.sealActiveHint()
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		if err := bpt.SaveMeta(); err != nil {
+			log.Printf("failed to save bptree index meta: %v\n", err)
+		}
+	}
+	if db.indexSnapshotEnabled() {
+		if err := db.saveIndexSnapshot(); err != nil {
+			log.Printf("failed to save index snapshot: %v\n", err)
+		}
+	}
+
 	// 关闭当前活跃文件
 	if err := db.activeFile.Close(); err != nil {
 		return err
@@ -210,11 +383,32 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size : %v", err))
 	}
+
+	var fileStats []*DataFileStat
+	for fid, file := range db.allDataFiles() {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			panic(fmt.Sprintf("failed to get data file size : %v", err))
+		}
+		reclaimable := db.fileReclaimSize[fid]
+		fileStats = append(fileStats, &DataFileStat{
+			FileId:          fid,
+			Size:            size,
+			LiveSize:        size - reclaimable,
+			ReclaimableSize: reclaimable,
+		})
+	}
+	sort.Slice(fileStats, func(i, j int) bool {
+		return fileStats[i].FileId < fileStats[j].FileId
+	})
+
 	return &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
+		DataFiles:       fileStats,
+		ReadOnly:        db.readOnly,
 	}
 }
 
@@ -227,30 +421,51 @@ func (db *DB) Backup(dir string) error {
 
 // Put 写入 Key/Value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL 写入带有过期时间的 Key/Value 数据，ttl 为 0 表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if ttl < 0 {
+		return ErrInvalidTTL
+	}
 
+	var expire int64
+	if ttl > 0 {
+		expire = time.Now().Add(ttl).UnixNano()
+	}
+	return db.put(key, value, expire)
+}
+
+// 写入 Key/Value 数据，expire 为过期时间的 UnixNano 时间戳
+func (db *DB) put(key []byte, value []byte, expire int64) error {
 	// 构造 LogRecord 结构体
 	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
+	}
+
+	// 每次写入都需要持久化时，通过组提交合并并发的写入
+	if db.options.SyncWrites {
+		return db.groupCommit(key, logRecord)
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 追加写入到当前活跃数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
-
-	// 更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
-
-	return nil
+	// 写入之后更新内存索引
+	return db.applyWrites([][]byte{key}, []*data.LogRecord{logRecord}, []*data.LogRecordPos{pos})[0]
 }
 
 // Delete 根据 key 删除对应的数据
@@ -261,7 +476,10 @@ func (db *DB) Delete(key []byte) error {
 	}
 
 	// 先检查 key 是否存在，如果不存在的话直接返回
-	if pos := db.index.Get(key); pos == nil {
+	db.mu.RLock()
+	pos := db.index.Get(key)
+	db.mu.RUnlock()
+	if pos == nil {
 		return nil
 	}
 
@@ -270,22 +488,20 @@ func (db *DB) Delete(key []byte) error {
 		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
 		Type: data.LogRecordDeleted,
 	}
+	if db.options.SyncWrites {
+		return db.groupCommit(key, logRecord)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	// 写入到数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
-	db.reclaimSize += int64(pos.Size)
-
-	// 从内存索引中将对应的 key 删除
-	oldPos, ok := db.index.Delete(key)
-	if !ok {
-		return ErrIndexUpdateFailed
-	}
-	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
-	return nil
+	// 写入之后从内存索引中将对应的 key 删除
+	return db.applyWrites([][]byte{key}, []*data.LogRecord{logRecord}, []*data.LogRecordPos{pos})[0]
 }
 
 // Get 根据 key 读取数据
@@ -300,8 +516,8 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 	// 从内存数据结构中取出 key 对应的索引信息
 	logRecordPos := db.index.Get(key)
-	// 如果 key 不在内存索引中，说明 key 不存在
-	if logRecordPos == nil {
+	// 如果 key 不在内存索引中或者已经过期，说明 key 不存在
+	if logRecordPos == nil || logRecordPos.IsExpired() {
 		return nil, ErrKeyNotFound
 	}
 
@@ -311,13 +527,18 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 // ListKeys 获取数据库中所有的 key
 func (db *DB) ListKeys() [][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired() {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -330,6 +551,9 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired() {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -341,41 +565,166 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	return nil
 }
 
+// 引用当前版本的数据文件集合，返回引用的版本，释放时需要传入
+// 之后被替换或者写满的数据文件在引用这个版本的读取都释放之前不会被关闭或者重新打开
+// 在访问此方法前必须持有读锁或者互斥锁
+func (db *DB) pinFiles() uint64 {
+	db.refMu.Lock()
+	defer db.refMu.Unlock()
+	db.fileRefs[db.fileGen]++
+	return db.fileGen
+}
+
+// 数据文件集合从当前版本中移除了一些文件，之后的引用使用新的版本
+// 在访问此方法前必须持有互斥锁
+func (db *DB) nextFileGen() {
+	db.refMu.Lock()
+	defer db.refMu.Unlock()
+	db.fileGen++
+}
+
+// 仍然被引用的最小版本，没有任何引用时返回当前版本加一
+// 在访问此方法前必须持有互斥锁
+func (db *DB) minPinnedFileGen() uint64 {
+	db.refMu.Lock()
+	defer db.refMu.Unlock()
+	minGen := db.fileGen + 1
+	for gen := range db.fileRefs {
+		if gen < minGen {
+			minGen = gen
+		}
+	}
+	return minGen
+}
+
+// 是否有快照、迭代器或者 merge 引用数据文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) filesPinned() bool {
+	db.refMu.Lock()
+	defer db.refMu.Unlock()
+	return len(db.fileRefs) > 0
+}
+
+// 获取当前所有的数据文件，包括活跃文件
+// 在访问此方法前必须持有读锁或者互斥锁
+func (db *DB) allDataFiles() map[uint32]*data.DataFile {
+	files := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, file := range db.olderFiles {
+		files[fid] = file
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+	return files
+}
+
+// 获取所有数据文件的总大小，hint 文件等辅助文件不计算在内
+// 在访问此方法前必须持有互斥锁
+func (db *DB) dataFilesSize() (int64, error) {
+	var totalSize int64
+	for _, file := range db.allDataFiles() {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		totalSize += size
+	}
+	return totalSize, nil
+}
+
+// 记录位置索引对应的数据已经无效，可以被 merge 回收
+func (db *DB) addReclaimSize(pos *data.LogRecordPos) {
+	db.reclaimSize += int64(pos.Size)
+	db.fileReclaimSize[pos.Fid] += int64(pos.Size)
+}
+
+// 释放对某个版本的数据文件集合的引用，关闭不再被任何读取引用的旧数据文件
+func (db *DB) unpinFiles(gen uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.refMu.Lock()
+	if db.fileRefs[gen]--; db.fileRefs[gen] <= 0 {
+		delete(db.fileRefs, gen)
+	}
+	db.refMu.Unlock()
+	if err := db.releaseStaleFiles(); err != nil {
+		log.Printf("failed to release stale data files: %v\n", err)
+	}
+}
+
+// merge 之后替换掉的旧数据文件，引用当前版本的读取都释放之后再关闭
+// 在访问此方法前必须持有互斥锁
+func (db *DB) retireFile(dataFile *data.DataFile) {
+	db.retiredFiles = append(db.retiredFiles, &staleFile{file: dataFile, gen: db.fileGen})
+}
+
+// 关闭没有引用的旧数据文件，并重新打开没有引用的写满的活跃文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) releaseStaleFiles() error {
+	minGen := db.minPinnedFileGen()
+	var firstErr error
+	var retiredFiles []*staleFile
+	for _, stale := range db.retiredFiles {
+		if stale.gen >= minGen {
+			retiredFiles = append(retiredFiles, stale)
+		} else if err := stale.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	db.retiredFiles = retiredFiles
+	if err := db.reopenSealedFiles(minGen); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
 // 根据索引信息获取对应的 value
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+	return db.readValueFromDataFile(db.dataFileOf(logRecordPos), logRecordPos)
+}
+
+// 根据文件 id 找到位置信息对应的数据文件
+// 在访问此方法前必须持有读锁或者互斥锁
+func (db *DB) dataFileOf(logRecordPos *data.LogRecordPos) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == logRecordPos.Fid {
+		return db.activeFile
 	}
+	return db.olderFiles[logRecordPos.Fid]
+}
+
+// 从指定的数据文件中读取 value
+func (db *DB) readValueFromDataFile(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
 	// 数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
 
 	// 根据偏移读取对应的数据
-	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	logRecord, _, err := readLogRecord(dataFile, logRecordPos.Offset, db.verifyOnRead())
 	if err != nil {
 		return nil, err
 	}
 
-	if logRecord.Type == data.LogRecordDeleted {
+	if logRecord.Type == data.LogRecordDeleted || logRecord.IsExpired() {
 		return nil, ErrKeyNotFound
 	}
 
-	return logRecord.Value, nil
-}
-
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+	return logRecord.DecodeValue()
 }
 
 // 追加写数据到活跃文件中
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	positions, err := db.appendLogRecords([]*data.LogRecord{logRecord})
+	if err != nil {
+		return nil, err
+	}
+	return positions[0], nil
+}
+
+// 追加写入多条数据，写入同一个活跃文件的数据合并为一次写入
+// 中途失败时返回已经持久化到写满的数据文件中的那部分数据的位置信息，当前活跃文件回滚到这部分数据之后
+// 在访问此方法前必须持有互斥锁
+func (db *DB) appendLogRecords(logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
 	// 判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
 	// 如果为空则初始化数据文件
 	if db.activeFile == nil {
@@ -384,30 +733,81 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
-	// 写入数据编码
-	encRecord, size := data.EncodeLogRecord(logRecord)
-	// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
-	if db.activeFile.WriteOff+size > db.options.DataFileSize {
-		// 先持久化数据文件，保证已有的数据持久到磁盘当中
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
+	var buf, hintBuf []byte
+	// 将暂存的数据写入到活跃文件中，写入成功之后才记录对应的 hint 记录
+	flush := func() error {
+		if err := db.writeActiveFile(buf); err != nil {
+			return err
 		}
+		if db.dataHintEnabled() {
+			db.activeHint = append(db.activeHint, hintBuf...)
+		}
+		buf, hintBuf = nil, nil
+		return nil
+	}
 
-		// 当前活跃文件转换为旧的数据文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-		// 打开新的数据文件
-		if err := db.setActiveDataFile(); err != nil {
-			return nil, err
+	positions := make([]*data.LogRecordPos, 0, len(logRecords))
+	// 已经持久化的数据数量，以及当前活跃文件中这部分数据之后的位置
+	synced, syncedOff, syncedHint := 0, db.activeFile.WriteOff, len(db.activeHint)
+	fail := func(err error) ([]*data.LogRecordPos, error) {
+		if db.activeFile.WriteOff > syncedOff {
+			if err := db.activeFile.Truncate(db.options.DirPath, syncedOff, db.options.ActiveFileIOType); err != nil {
+				log.Printf("failed to truncate data file %d after write error: %v\n", db.activeFile.FileId, err)
+			}
 		}
+		db.activeHint = db.activeHint[:syncedHint]
+		return positions[:synced], err
 	}
 
-	writeOff := db.activeFile.WriteOff
-	if err := db.activeFile.Write(encRecord); err != nil {
-		return nil, err
+	for _, logRecord := range logRecords {
+		// 压缩 value 并编码
+		logRecord, err := db.compressLogRecord(logRecord)
+		if err != nil {
+			return fail(err)
+		}
+		encRecord, size, err := db.cipher.EncodeLogRecord(logRecord, db.options.Checksum)
+		if err != nil {
+			return fail(err)
+		}
+		// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
+		if db.activeFile.WriteOff+int64(len(buf))+size > db.options.DataFileSize {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+			if err := db.rotateActiveFile(); err != nil {
+				return fail(err)
+			}
+			// 写满的数据文件已经持久化
+			synced, syncedOff, syncedHint = len(positions), db.activeFile.WriteOff, 0
+		}
+
+		// 磁盘空间不足时拒绝写入，避免写入不完整的记录
+		if err := db.checkDiskSpace(size); err != nil {
+			return fail(err)
+		}
+
+		// 构造内存索引信息
+		pos := &data.LogRecordPos{
+			Fid:    db.activeFile.FileId,
+			Offset: db.activeFile.WriteOff + int64(len(buf)),
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		}
+		positions = append(positions, pos)
+		buf = append(buf, encRecord...)
+		if db.dataHintEnabled() {
+			hintRecord, err := data.EncodeHintRecord(db.cipher, db.options.Checksum, logRecord.Key, logRecord.Type, pos)
+			if err != nil {
+				return fail(err)
+			}
+			hintBuf = append(hintBuf, hintRecord...)
+		}
+		db.bytesWrite += uint(size)
+	}
+	if err := flush(); err != nil {
+		return fail(err)
 	}
 
-	db.bytesWrite += uint(size)
 	// 根据用户配置决定是否持久化
 	var needSync = db.options.SyncWrites
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
@@ -415,17 +815,102 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 	if needSync {
 		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
+			return fail(err)
 		}
 		// 清空累计值
 		if db.bytesWrite > 0 {
 			db.bytesWrite = 0
 		}
 	}
+	return positions, nil
+}
+
+// 写入数据文件之后更新内存索引，keys 为每一条数据对应的 key，返回每一条数据的更新结果
+// 所有的更新通过一次批量操作完成，B+ 树索引只需要一个事务
+// 在访问此方法前必须持有互斥锁
+func (db *DB) applyWrites(keys [][]byte, logRecords []*data.LogRecord, positions []*data.LogRecordPos) []error {
+	ops := make([]*index.BatchOp, len(positions))
+	seqNos := make([]uint64, len(positions))
+	for i, pos := range positions {
+		// B+ 树索引写入时会同时保存当前的序列号，需要先递增
+		seqNos[i] = atomic.AddUint64(&db.seqNo, 1)
+		ops[i] = &index.BatchOp{Key: keys[i], Pos: pos, Delete: logRecords[i].Type == data.LogRecordDeleted}
+	}
+
+	errs := make([]error, len(positions))
+	for i, oldPos := range index.ApplyBatch(db.index, ops) {
+		db.markKeyModified(keys[i], seqNos[i], oldPos)
+		if oldPos != nil {
+			db.addReclaimSize(oldPos)
+		}
+		if ops[i].Delete {
+			// 删除记录本身也是可以回收的数据
+			db.addReclaimSize(positions[i])
+			// 写入之前 key 已经被并发删除
+			if oldPos == nil {
+				errs[i] = ErrIndexUpdateFailed
+			}
+		}
+	}
+	return errs
+}
+
+// 将编码之后的数据写入到活跃文件中，磁盘空间不足时截断写入了一部分的数据
+// 在访问此方法前必须持有互斥锁
+func (db *DB) writeActiveFile(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	writeOff := db.activeFile.WriteOff
+	if err := db.activeFile.Write(buf); err != nil {
+		if !errors.Is(err, syscall.ENOSPC) {
+			return err
+		}
+		db.readOnly = true
+		if err := db.activeFile.Truncate(db.options.DirPath, writeOff, db.options.ActiveFileIOType); err != nil {
+			log.Printf("failed to truncate data file %d after disk full: %v\n", db.activeFile.FileId, err)
+		}
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// 检查磁盘剩余空间是否足够写入，低于预留空间时切换为只读模式
+// 为了避免每次写入都获取文件系统信息，只有累计写入较多或者估算的剩余空间接近预留空间时才重新获取
+// 只读模式下每次写入都重新获取，剩余空间重新高于预留空间之后恢复写入
+// 在访问此方法前必须持有互斥锁
+func (db *DB) checkDiskSpace(size int64) error {
+	if db.readOnly {
+		available, err := utils.AvailableDiskSize(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		if uint64(size)+db.options.DiskReserveSize > available {
+			return ErrDiskFull
+		}
+		db.readOnly = false
+		db.diskAvailable = available
+		db.diskWritten = 0
+	}
+	if db.options.DiskReserveSize == 0 {
+		return nil
+	}
 
-	// 构造内存索引信息
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
-	return pos, nil
+	required := db.diskWritten + uint64(size) + db.options.DiskReserveSize
+	if db.diskWritten >= diskCheckBytes || required > db.diskAvailable {
+		available, err := utils.AvailableDiskSize(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		db.diskAvailable = available
+		db.diskWritten = 0
+		if uint64(size)+db.options.DiskReserveSize > available {
+			db.readOnly = true
+			return ErrDiskFull
+		}
+	}
+	db.diskWritten += uint64(size)
+	return nil
 }
 
 // 设置当前活跃文件
@@ -436,61 +921,84 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1
 	}
 	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, db.options.ActiveFileIOType, db.options.Checksum, db.options.DataFileSize)
 	if err != nil {
+		// 预先分配磁盘空间失败
+		if errors.Is(err, syscall.ENOSPC) {
+			db.readOnly = true
+			return ErrDiskFull
+		}
 		return err
 	}
+	dataFile.Cipher = db.cipher
 	db.activeFile = dataFile
 	return nil
 }
 
 // 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() error {
-	dirEntries, err := os.ReadDir(db.options.DirPath)
+	fileIds, err := getDataFileIds(db.options.DirPath)
 	if err != nil {
 		return err
 	}
-
-	var fileIds []int
-	// 遍历目录中的所有文件，找到所有以 .data 结尾的文件
-	for _, entry := range dirEntries {
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
-			splitNames := strings.Split(entry.Name(), ".")
-			fileId, err := strconv.Atoi(splitNames[0])
-			// 数据目录有可能被损坏了
-			if err != nil {
-				return ErrDataDirectoryCorrupted
-			}
-			fileIds = append(fileIds, fileId)
-		}
-	}
-
-	// 对文件 id 进行排序，从小到大依次加载
-	sort.Ints(fileIds)
 	db.fileIds = fileIds
 
 	// 遍历每个文件id，打开对应的数据文件
 	for i, fid := range fileIds {
-		ioType := fio.StandardFIO
+		ioType, preallocSize := db.options.OlderFileIOType, int64(0)
+		if i == len(fileIds)-1 {
+			ioType, preallocSize = db.options.ActiveFileIOType, db.options.DataFileSize
+		}
 		if db.options.MMapAtStartup {
 			ioType = fio.MemoryMap
 		}
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType)
+		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid), ioType, db.options.Checksum, preallocSize)
 		if err != nil {
 			return err
 		}
+		dataFile.Cipher = db.cipher
 		if i == len(fileIds)-1 { // 最后一个，id是最大的，说明是当前活跃文件
 			db.activeFile = dataFile
 		} else { // 说明是旧的数据文件
+			if err := db.trimZeroTail(dataFile, ioType); err != nil {
+				_ = dataFile.Close()
+				return err
+			}
 			db.olderFiles[uint32(fid)] = dataFile
 		}
 	}
 	return nil
 }
 
+// 获取目录中所有数据文件的 id，从小到大排序
+func getDataFileIds(dirPath string) ([]int, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIds []int
+	// 遍历目录中的所有文件，找到所有以 .data 结尾的文件
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			splitNames := strings.Split(entry.Name(), ".")
+			fileId, err := strconv.Atoi(splitNames[0])
+			// 数据目录有可能被损坏了
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+
+	// 对文件 id 进行排序，从小到大依次加载
+	sort.Ints(fileIds)
+	return fileIds, nil
+}
+
 // 从数据文件中加载索引
-// 遍历文件中的所有记录，并更新到内存索引中
-func (db *DB) loadIndexFromDataFiles() error {
+// 遍历文件中的所有记录，并更新到内存索引中，位于 startFileId 和 startOffset 之前的记录已经从快照中加载
+func (db *DB) loadIndexFromDataFiles(startFileId uint32, startOffset int64) error {
 	// 没有文件，说明数据库是空的，直接返回
 	if len(db.fileIds) == 0 {
 		return nil
@@ -508,89 +1016,338 @@ func (db *DB) loadIndexFromDataFiles() error {
 		nonMergeFileId = fid
 	}
 
+	// 暂存索引的更新，每处理完一个数据文件批量更新一次索引
+	var ops []*index.BatchOp
 	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
+		// 已经过期的数据和删除的数据一样处理
+		if typ == data.LogRecordDeleted || pos.IsExpired() {
+			ops = append(ops, &index.BatchOp{Key: key, Delete: true})
+			db.addReclaimSize(pos)
 		} else {
-			oldPos = db.index.Put(key, pos)
+			ops = append(ops, &index.BatchOp{Key: key, Pos: pos})
 		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+	}
+	flushIndex := func() {
+		for _, oldPos := range index.ApplyBatch(db.index, ops) {
+			if oldPos != nil {
+				db.addReclaimSize(oldPos)
+			}
 		}
+		ops = nil
 	}
 
 	// 暂存事务数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
+	var currentSeqNo = db.seqNo
+
+	// 处理数据文件中的一条记录
+	handleRecord := func(key []byte, typ data.LogRecordType, logRecordPos *data.LogRecordPos) {
+		// 解析 key，拿到事务序列号
+		realKey, seqNo := parseLogRecordKey(key)
+		if seqNo == nonTransactionSeqNo {
+			// 非事务操作，直接更新内存索引
+			updateIndex(realKey, typ, logRecordPos)
+		} else {
+			// 事务完成，对应的 seq no 的数据可以更新到内存索引中
+			if typ == data.LogRecordTxnFinished {
+				for _, txnRecord := range transactionRecords[seqNo] {
+					updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+				}
+				delete(transactionRecords, seqNo)
+			} else {
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
+					Record: &data.LogRecord{Key: realKey, Type: typ},
+					Pos:    logRecordPos,
+				})
+			}
+		}
 
-	// 遍历所有的文件id，处理文件中的记录
-	for i, fid := range db.fileIds {
-		var fileId = uint32(fid)
+		// 更新事务序列号
+		if seqNo > currentSeqNo {
+			currentSeqNo = seqNo
+		}
+	}
+
+	applyEntries := func(entries []*hintEntry) {
+		for _, entry := range entries {
+			if entry.pos.Fid == startFileId && entry.pos.Offset < startOffset {
+				continue
+			}
+			handleRecord(entry.key, entry.typ, entry.pos)
+		}
+		flushIndex()
+	}
+
+	// 需要从数据文件中加载索引的文件
+	var fileIds []uint32
+	for _, fid := range db.fileIds {
 		// 如果比最近未参与 merge 的文件 id 更小，则说明已经从 Hint 文件中加载索引了
-		if hasMerge && fileId < nonMergeFileId {
+		if hasMerge && uint32(fid) < nonMergeFileId || uint32(fid) < startFileId {
 			continue
 		}
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fileId]
+		fileIds = append(fileIds, uint32(fid))
+	}
+	if len(fileIds) == 0 {
+		db.seqNo = currentSeqNo
+		return nil
+	}
+
+	// 旧的数据文件不会再被修改，可以并发读取，读取的结果按照文件 id 从小到大依次更新到内存索引中
+	olderFileIds := fileIds[:len(fileIds)-1]
+	results := make([]chan *dataFileScanResult, len(olderFileIds))
+	for i := range results {
+		results[i] = make(chan *dataFileScanResult, 1)
+	}
+	workers := db.options.IndexLoadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// 限制已经开始读取但还没有被处理的文件数量，避免占用过多的内存
+	tokens := make(chan struct{}, workers)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i, fileId := range olderFileIds {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			go func(i int, fileId uint32) {
+				results[i] <- db.scanDataFile(db.olderFiles[fileId], false)
+			}(i, fileId)
 		}
+	}()
 
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	for i := range olderFileIds {
+		result := <-results[i]
+		<-tokens
+		if result.err != nil {
+			return result.err
+		}
+		applyEntries(result.entries)
+	}
+
+	// 最后处理当前活跃文件，末尾可能有未写完整的记录
+	result := db.scanDataFile(db.activeFile, true)
+	if result.err != nil {
+		return result.err
+	}
+	applyEntries(result.entries)
+	db.activeFile.WriteOff = result.size
+	db.activeHint = result.hintBuf
+
+	// 更新事务序列号
+	db.seqNo = currentSeqNo
+	return nil
+}
+
+// 扫描当前活跃文件，找到最后一条完整记录的位置作为 WriteOff
+func (db *DB) loadActiveFileWriteOff() error {
+	offset := db.activeFile.HeaderSize()
+	for {
+		_, size, err := db.activeFile.ReadLogRecord(offset)
+		if err != nil {
+			if err := db.recoverTornTail(db.activeFile, offset, err); err != nil {
 				return err
 			}
+			break
+		}
+		offset += size
+	}
+	db.activeFile.WriteOff = offset
+	return nil
+}
 
-			// 构造内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
+// 处理读取最新数据文件时遇到的错误
+// 进程崩溃可能导致文件末尾的记录没有写完整，将文件截断到最后一条有效记录的位置
+// 只有之后没有任何能够通过校验的记录时才是写入不完整的末尾，否则是文件中间的数据损坏，直接返回错误
+func (db *DB) recoverTornTail(dataFile *data.DataFile, offset int64, readErr error) error {
+	if readErr != io.EOF && readErr != io.ErrUnexpectedEOF && readErr != data.ErrInvalidCRC {
+		return readErr
+	}
+	// 严格模式下保持原有的行为，遇到损坏的记录直接返回错误
+	// 全 0 的数据会被读取为 EOF，是预先扩展的文件没有正常关闭留下的，总是截断
+	if db.options.StrictRecovery && readErr != io.EOF {
+		return readErr
+	}
 
-			// 解析 key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务操作，直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 事务完成，对应的 seq no 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if offset >= fileSize {
+		return nil
+	}
+	found, err := hasRecordAfter(dataFile, offset, fileSize)
+	if err != nil {
+		return err
+	}
+	if found {
+		if readErr == io.EOF {
+			readErr = data.ErrInvalidCRC
+		}
+		return fmt.Errorf("data file %d is corrupted at offset %d and followed by valid records: %w",
+			dataFile.FileId, offset, readErr)
+	}
+	log.Printf("data file %d is corrupted at offset %d (%v), truncate %d bytes\n",
+		dataFile.FileId, offset, readErr, fileSize-offset)
+	return dataFile.Truncate(db.options.DirPath, offset, db.options.ActiveFileIOType)
+}
+
+// 使用可读写的内存文件映射时进程崩溃，旧的数据文件末尾会留下预先扩展的全 0 数据，截断到最后一条记录的末尾
+// 只有文件的最后一个字节为 0 时才需要逐条读取记录，损坏的记录不在这里处理
+func (db *DB) trimZeroTail(dataFile *data.DataFile, ioType fio.FileIOType) error {
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if fileSize <= dataFile.HeaderSize() {
+		return nil
+	}
+	last := make([]byte, 1)
+	if _, err := dataFile.IoManager.Read(last, fileSize-1); err != nil {
+		return err
+	}
+	if last[0] != 0 {
+		return nil
+	}
+
+	offset := dataFile.HeaderSize()
+	for {
+		_, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		offset += size
+	}
+	if offset >= fileSize {
+		return nil
+	}
+	if found, err := hasRecordAfter(dataFile, offset, fileSize); err != nil || found {
+		return err
+	}
+	log.Printf("data file %d has %d bytes of preallocated space at the end, truncate\n", dataFile.FileId, fileSize-offset)
+	return dataFile.Truncate(db.options.DirPath, offset, ioType)
+}
+
+// 判断 offset 之后是否还有能够通过校验的记录，逐字节向后查找
+// 头部全 0 的位置会被读取为 EOF，不可能是记录的开头，直接跳过，避免逐条读取预先扩展的空间
+func hasRecordAfter(dataFile *data.DataFile, offset int64, fileSize int64) (bool, error) {
+	const zeroHeaderSize = 7 // crc type keySize valueSize 都为 0 时的头部长度
+	buf := make([]byte, 64*1024)
+	for base := offset + 1; base < fileSize; {
+		n := int64(len(buf))
+		if base+n > fileSize {
+			n = fileSize - base
+		}
+		if _, err := dataFile.IoManager.Read(buf[:n], base); err != nil {
+			return false, err
+		}
+		for i := int64(0); i < n; i++ {
+			if i+zeroHeaderSize <= n && bytes.Count(buf[i:i+zeroHeaderSize], []byte{0}) == zeroHeaderSize {
+				continue
 			}
+			_, _, err := dataFile.ReadLogRecord(base + i)
+			if err == nil {
+				return true, nil
+			}
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != data.ErrInvalidCRC {
+				return false, err
+			}
+		}
+		base += n
+	}
+	return false, nil
+}
+
+// 读取单个数据文件的结果
+type dataFileScanResult struct {
+	entries []*hintEntry // 数据文件中的所有记录，按照写入的顺序排列
+	hintBuf []byte       // 所有记录编码之后的 hint 记录
+	size    int64        // 数据文件中有效数据的大小
+	err     error
+}
+
+// 读取数据文件中所有记录的 key 和位置，优先从 hint 文件中加载，hint 文件没有覆盖的部分再从数据文件中读取
+// 旧的数据文件没有完整的 hint 文件时补写 hint 文件，加快下次启动的速度
+func (db *DB) scanDataFile(dataFile *data.DataFile, isActiveFile bool) *dataFileScanResult {
+	fileId := dataFile.FileId
+	fileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return &dataFileScanResult{err: err}
+	}
 
-			// 更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+	result := &dataFileScanResult{size: dataFile.HeaderSize()}
+	entries, hintSize, err := readDataHintFile(db.options.DirPath, fileId, db.cipher)
+	if err == nil && hintSize <= fileSize {
+		result.entries = entries
+		result.size = hintSize
+	}
+	// 旧的数据文件已经有完整的 hint 文件时，不需要再编码 hint 记录
+	hintComplete := result.size == fileSize
+	needHintBuf := isActiveFile || !hintComplete
+	if needHintBuf {
+		for _, entry := range result.entries {
+			hintRecord, err := data.EncodeHintRecord(db.cipher, db.options.Checksum, entry.key, entry.typ, entry.pos)
+			if err != nil {
+				return &dataFileScanResult{err: err}
 			}
+			result.hintBuf = append(result.hintBuf, hintRecord...)
+		}
+	}
 
-			// 递增 offset，下一次从新的位置开始读取
-			offset += size
+	for {
+		// 最新的数据文件需要通过 crc 识别末尾写入不完整的记录，总是校验
+		logRecord, size, err := readLogRecord(dataFile, result.size, isActiveFile || db.verifyOnScan())
+		if err != nil {
+			// 最新的数据文件末尾可能有未写完整的记录
+			if isActiveFile {
+				if err := db.recoverTornTail(dataFile, result.size, err); err != nil {
+					result.err = err
+				}
+				break
+			}
+			if err != io.EOF {
+				result.err = err
+			}
+			break
 		}
 
-		// 如果是当前活跃文件，更新这个文件的 WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		// 构造内存索引，拷贝 key 避免引用整条记录的内存
+		entry := &hintEntry{
+			key: append([]byte(nil), logRecord.Key...),
+			typ: logRecord.Type,
+			pos: &data.LogRecordPos{
+				Fid:    fileId,
+				Offset: result.size,
+				Size:   uint32(size),
+				Expire: logRecord.Expire,
+			},
+		}
+		result.entries = append(result.entries, entry)
+		if needHintBuf {
+			hintRecord, err := data.EncodeHintRecord(db.cipher, db.options.Checksum, entry.key, entry.typ, entry.pos)
+			if err != nil {
+				result.err = err
+				break
+			}
+			result.hintBuf = append(result.hintBuf, hintRecord...)
 		}
+
+		// 递增 offset，下一次从新的位置开始读取
+		result.size += size
 	}
 
-	// 更新事务序列号
-	db.seqNo = currentSeqNo
-	return nil
+	if result.err == nil && !isActiveFile && !hintComplete {
+		if err := writeDataHintFile(db.options.DirPath, fileId, db.options.Checksum, result.hintBuf, result.size); err != nil {
+			log.Printf("failed to write hint file for data file %d: %v\n", fileId, err)
+		}
+	}
+	return result
 }
 
 func checkOptions(options Options) error {
@@ -603,9 +1360,41 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.MergeMode != MergeAll && options.MergeMode != MergeSelective {
+		return errors.New("invalid merge mode")
+	}
+	if options.FileMergeRatio < 0 || options.FileMergeRatio > 1 {
+		return errors.New("invalid file merge ratio, must between 0 and 1")
+	}
+	if _, ok := data.GetCompressor(options.Compression); !ok && options.Compression != NoCompression {
+		return errors.New("unknown compression type")
+	}
+	if options.CompressionThreshold < 0 {
+		return errors.New("compression threshold must not be negative")
+	}
+	if !validFileIOType(options.ActiveFileIOType) || !validFileIOType(options.OlderFileIOType) {
+		return errors.New("invalid file io type")
+	}
+	if !data.ValidChecksum(options.Checksum) {
+		return errors.New("unknown checksum type")
+	}
+	if options.VerifyChecksums < VerifyAlways || options.VerifyChecksums > VerifyNever {
+		return errors.New("invalid verify checksums policy")
+	}
+	if options.AutoMergeInterval < 0 {
+		return errors.New("auto merge interval must not be negative")
+	}
+	if options.AutoMergeWindowStart < 0 || options.AutoMergeWindowStart >= 24*time.Hour ||
+		options.AutoMergeWindowEnd < 0 || options.AutoMergeWindowEnd >= 24*time.Hour {
+		return errors.New("invalid auto merge window, must between 0 and 24 hours")
+	}
 	return nil
 }
 
+func validFileIOType(ioType FileIOType) bool {
+	return ioType == StandardIO || ioType == MMapIO
+}
+
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
@@ -627,17 +1416,17 @@ func (db *DB) loadSeqNo() error {
 	return os.Remove(fileName)
 }
 
-// 将数据文件的 IO 类型设置为标准文件 IO
+// 将数据文件的 IO 类型设置为配置的 IO 类型
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
 
-	if err := db.activeFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+	if err := db.activeFile.SetIOManager(db.options.DirPath, db.options.ActiveFileIOType); err != nil {
 		return err
 	}
 	for _, dataFile := range db.olderFiles {
-		if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		if err := dataFile.SetIOManager(db.options.DirPath, db.options.OlderFileIOType); err != nil {
 			return err
 		}
 	}
@@ -1,9 +1,25 @@
 package scache
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/fio"
+	"github.com/sharch/scache/index"
+	"github.com/sharch/scache/utils"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUint32(t *testing.T) {
@@ -21,3 +37,2151 @@ func TestUint32(t *testing.T) {
 	}
 	t.Log(fileIds)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutWithTTL([]byte("short"), []byte("v1"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL([]byte("long"), []byte("v2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("short")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get([]byte("short")); err != ErrKeyNotFound {
+		t.Fatalf("expected expired key to be not found, got %v", err)
+	}
+	if keys := db.ListKeys(); len(keys) != 1 || string(keys[0]) != "long" {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启之后过期的数据不会被加载到索引中
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get([]byte("short")); err != ErrKeyNotFound {
+		t.Fatalf("expected expired key to be not found after reopen, got %v", err)
+	}
+	if val, err := db.Get([]byte("long")); err != nil || string(val) != "v2" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "snapshot")
+	opts.DataFileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	// 快照之后的写入在快照中不可见
+	if err := db.Put(utils.GetTestKey(0), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(utils.GetTestKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(utils.GetTestKey(10), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := snap.Get(utils.GetTestKey(0)); err != nil || string(val) != "old" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+	if _, err := snap.Get(utils.GetTestKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.Get(utils.GetTestKey(10)); err != ErrKeyNotFound {
+		t.Fatalf("expected key not found, got %v", err)
+	}
+
+	var count int
+	if err := snap.Fold(func(key []byte, value []byte) bool {
+		if string(value) != "old" {
+			t.Fatalf("unexpected value %q for key %q", value, key)
+		}
+		count++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Fatalf("expected 10 keys in snapshot, got %d", count)
+	}
+
+	// merge 替换数据文件之后，快照仍然可以读取旧版本的数据
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := snap.Get(utils.GetTestKey(0)); err != nil || string(val) != "old" {
+		t.Fatalf("unexpected value %q after merge, err %v", val, err)
+	}
+	if val, err := db.Get(utils.GetTestKey(0)); err != nil || string(val) != "new" {
+		t.Fatalf("unexpected value %q after merge, err %v", val, err)
+	}
+	if _, err := db.Get(utils.GetTestKey(1)); err != ErrKeyNotFound {
+		t.Fatalf("expected key not found after merge, got %v", err)
+	}
+
+	// 快照存在期间并发写入，快照中的数据保持不变
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			key := utils.GetTestKey(i % 20)
+			if i%3 == 0 {
+				_ = db.Delete(key)
+			} else {
+				_ = db.Put(key, []byte("newer"))
+			}
+		}
+	}()
+	for n := 0; n < 20; n++ {
+		count = 0
+		if err := snap.Fold(func(key []byte, value []byte) bool {
+			if string(value) != "old" {
+				t.Errorf("unexpected value %q for key %q", value, key)
+			}
+			count++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if count != 10 {
+			t.Fatalf("expected 10 keys in snapshot, got %d", count)
+		}
+	}
+	wg.Wait()
+
+	// 快照释放之后不再记录修改之前的位置信息
+	snap.Release()
+	if _, err := snap.Get(utils.GetTestKey(0)); err != ErrSnapshotReleased {
+		t.Fatalf("expected snapshot released, got %v", err)
+	}
+	if len(db.keyVersions) != 0 {
+		t.Fatalf("expected key versions to be pruned, got %d", len(db.keyVersions))
+	}
+
+	// 旧的迭代器释放之后，merge 替换掉的文件不需要等待之后创建的快照释放
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.retiredFiles) == 0 {
+		t.Fatal("expected retired files referenced by the iterator")
+	}
+	newSnap := db.Snapshot()
+	defer newSnap.Release()
+	iterator.Close()
+	if len(db.retiredFiles) != 0 {
+		t.Fatalf("expected retired files closed, got %d", len(db.retiredFiles))
+	}
+
+	// 快照引用的文件在快照释放之后关闭
+	if err := db.Put(utils.GetTestKey(0), []byte("newest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.retiredFiles) == 0 {
+		t.Fatal("expected retired files referenced by the snapshot")
+	}
+	if val, err := newSnap.Get(utils.GetTestKey(0)); err != nil || string(val) == "newest" {
+		t.Fatalf("unexpected value %q in snapshot, err %v", val, err)
+	}
+	newSnap.Release()
+	if len(db.retiredFiles) != 0 || len(db.fileRefs) != 0 {
+		t.Fatalf("expected all files released, got %d retired files and %d referenced versions", len(db.retiredFiles), len(db.fileRefs))
+	}
+}
+
+func TestDB_TxnConflict(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("balance"), []byte("100")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn1, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn2, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn1.Get([]byte("balance")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn2.Get([]byte("balance")); err != nil {
+		t.Fatal(err)
+	}
+	_ = txn1.Put([]byte("balance"), []byte("90"))
+	_ = txn2.Put([]byte("balance"), []byte("80"))
+
+	// 事务能读到自身未提交的写入
+	if val, err := txn1.Get([]byte("balance")); err != nil || string(val) != "90" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn2.Commit(); err != ErrTxnConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if val, err := db.Get([]byte("balance")); err != nil || string(val) != "90" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+
+	// 删除快照中不存在的 key，事务开始之后这个 key 被其他写入新增时提交失败
+	txn3, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn3.Delete([]byte("coupon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("coupon"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn3.Commit(); err != ErrTxnConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+}
+
+func TestDB_OpenWithTornTail(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = t.TempDir()
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put(utils.GetTestKey(i), utils.RandomValue(24)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入过程中进程崩溃，数据文件末尾留下半条记录
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: []byte("value")})
+	f, err := os.OpenFile(data.GetDataFileName(opts.DirPath, 0), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(record[:len(record)-3])
+	_ = f.Close()
+
+	strictOpts := opts
+	strictOpts.StrictRecovery = true
+	if _, err := Open(strictOpts); err == nil {
+		t.Fatal("expected strict recovery to fail")
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("after"), []byte("crash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.ListKeys(); len(keys) != 101 {
+		t.Fatalf("expected 101 keys, got %d", len(keys))
+	}
+	if val, err := db.Get([]byte("after")); err != nil || string(val) != "crash" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件中间的记录损坏时之后还有有效的记录，不能截断
+	fileName := data.GetDataFileName(opts.DirPath, 0)
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)/2] ^= 0xff
+	if err := os.WriteFile(fileName, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 删除 hint 文件和索引快照，打开时重新读取整个数据文件
+	_ = os.Remove(data.GetHintFileName(opts.DirPath, 0))
+	_ = os.Remove(filepath.Join(opts.DirPath, data.IndexSnapshotFileName))
+	if _, err := Open(opts); !errors.Is(err, data.ErrInvalidCRC) {
+		t.Fatalf("expected ErrInvalidCRC, got %v", err)
+	}
+	if stat, err := os.Stat(fileName); err != nil || stat.Size() != int64(len(raw)) {
+		t.Fatalf("data file was modified, err %v", err)
+	}
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "auto-merge")
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 反复覆盖写入，产生大量的无效数据
+	for n := 0; n < 10; n++ {
+		for i := 0; i < 500; i++ {
+			if err := db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before := db.Stat()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.AutoMergeInterval = 20 * time.Millisecond
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stat().DataFileNum >= before.DataFileNum {
+		if time.Now().After(deadline) {
+			t.Fatal("auto merge did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 500; i++ {
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != "9" {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.AutoMergeInterval = 0
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if keys := db.ListKeys(); len(keys) != 500 {
+		t.Fatalf("expected 500 keys, got %d", len(keys))
+	}
+	for i := 0; i < 500; i++ {
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != "9" {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+}
+
+func TestDB_MergeSelective(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "merge-selective")
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte(strings.Repeat("v", 64))
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 先进行一次完整的 merge，生成 hint 文件
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只让前面的数据文件产生无效数据
+	for i := 0; i < 200; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 200; i < 300; i++ {
+		if err := db.Delete(utils.GetTestKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.options.MergeMode = MergeSelective
+	db.options.FileMergeRatio = 0.5
+	before := db.Stat()
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	after := db.Stat()
+	if after.ReclaimableSize >= before.ReclaimableSize || after.DataFileNum != before.DataFileNum {
+		t.Fatalf("unexpected stat before %+v after %+v", before, after)
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 200:
+				if err != nil || string(val) != "new" {
+					t.Fatalf("unexpected value %q, err %v", val, err)
+				}
+			case i < 300:
+				if err != ErrKeyNotFound {
+					t.Fatalf("expected deleted key, err %v", err)
+				}
+			default:
+				if err != nil || string(val) != string(value) {
+					t.Fatalf("unexpected value %q, err %v", val, err)
+				}
+			}
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDB_MergeSelectiveExpired(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "merge-selective-expired")
+	opts.DataFileSize = 32 * 1024
+	opts.MergeMode = MergeSelective
+	opts.FileMergeRatio = 0.5
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 前面的数据文件中是没有过期时间的旧数据，之后使用过期时间覆盖
+	value := []byte(strings.Repeat("v", 64))
+	for i := 0; i < 300; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 300; i++ {
+		if err := db.PutWithTTL(utils.GetTestKey(i), value, 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 300; i < 1000; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 过期的数据计入可以回收的数据量，包含过期数据的文件会被重写
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	for fid, file := range db.olderFiles {
+		offset := file.HeaderSize()
+		for {
+			logRecord, size, err := file.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if logRecord.Expire != 0 {
+				t.Fatalf("expired record left in data file %d at offset %d", fid, offset)
+			}
+			offset += size
+		}
+	}
+
+	// 过期的数据被替换为删除的标记，重启之后旧数据不会被重新加载
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i < 300 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("expected expired key %d, got %q, err %v", i, val, err)
+				}
+			} else if err != nil || !bytes.Equal(val, value) {
+				t.Fatalf("unexpected value %q, err %v", val, err)
+			}
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 从数据文件中重新加载索引
+	if err := os.Remove(filepath.Join(opts.DirPath, data.IndexSnapshotFileName)); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDB_MergeWithOptions(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "merge-options")
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 500; i++ {
+			if err := db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 取消的 merge 不会留下 merge 目录
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.MergeWithOptions(ctx, DefaultMergeOptions); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if _, err := os.Stat(db.getMergePath()); !os.IsNotExist(err) {
+		t.Fatalf("merge dir should be removed, err %v", err)
+	}
+
+	var progress []MergeProgress
+	mergeOpts := MergeOptions{
+		BytesPerSecond: 1024 * 1024,
+		OnProgress: func(p MergeProgress) {
+			progress = append(progress, p)
+		},
+	}
+	if err := db.MergeWithOptions(context.Background(), mergeOpts); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) == 0 {
+		t.Fatal("progress callback not called")
+	}
+	last := progress[len(progress)-1]
+	if last.FilesDone != last.FilesTotal || last.BytesCopied == 0 || last.BytesCopied > last.BytesRead {
+		t.Fatalf("unexpected progress %+v", last)
+	}
+	for i := 0; i < 500; i++ {
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != "2" {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+}
+
+func TestDB_MergeInstallFailed(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "merge-install")
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 500; i++ {
+			if err := db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func() {
+		for i := 0; i < 500; i++ {
+			if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != "2" {
+				t.Fatalf("unexpected value %q for key %d, err %v", val, i, err)
+			}
+		}
+	}
+
+	// 索引快照的位置被非空目录占用，移动 merge 之后的文件失败
+	blocker := filepath.Join(opts.DirPath, data.IndexSnapshotFileName)
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err == nil || err == ErrMergeNotInstalled {
+		t.Fatalf("expected merge install error, got %v", err)
+	}
+	// 继续使用原来的数据文件和索引
+	check()
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != ErrMergeNotInstalled {
+		t.Fatalf("expected merge not installed, got %v", err)
+	}
+
+	// 重新打开时完成上一次的 merge
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+	if _, err := os.Stat(db.getMergePath()); !os.IsNotExist(err) {
+		t.Fatalf("merge dir should be removed, err %v", err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestDB_DiskFull(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "disk-full")
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 预留空间超过磁盘剩余空间，写入失败并切换为只读模式
+	db.options.DiskReserveSize = 1 << 62
+	if err := db.Put([]byte("key"), []byte("new")); err != ErrDiskFull {
+		t.Fatalf("expected disk full, got %v", err)
+	}
+	if !db.Stat().ReadOnly {
+		t.Fatal("db should be read only")
+	}
+
+	if err := db.Delete([]byte("key")); err != ErrDiskFull {
+		t.Fatalf("expected disk full, got %v", err)
+	}
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+
+	// 剩余空间重新高于预留空间之后恢复写入
+	db.options.DiskReserveSize = 1024
+	if err := db.Put([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stat().ReadOnly {
+		t.Fatal("db should be writable again")
+	}
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "new" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+}
+
+// 获取磁盘剩余空间的实现按平台区分，各平台 Statfs 的字段类型不同，交叉编译检查每个平台
+func TestDB_AvailableDiskSizeCrossBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cross build in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	for _, goos := range []string{"linux", "darwin", "freebsd", "openbsd", "netbsd", "solaris", "windows"} {
+		cmd := exec.Command(goBin, "build", "./utils")
+		cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH=amd64", "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("build utils for %s failed: %v\n%s", goos, err, out)
+		}
+	}
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	for name, typ := range map[string]IndexerType{"btree": BTree, "bptree": BPlusTree} {
+		t.Run(name, func(t *testing.T) {
+			testGroupCommit(t, typ)
+		})
+	}
+}
+
+func testGroupCommit(t *testing.T, typ IndexerType) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "group-commit")
+	opts.DataFileSize = 16 * 1024
+	opts.SyncWrites = true
+	opts.IndexType = typ
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * 100; i < (g+1)*100; i++ {
+				if err := db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(i))); err != nil {
+					errs <- err
+					return
+				}
+				if i%10 == 0 {
+					if err := db.Delete(utils.GetTestKey(i)); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		if keys := db.ListKeys(); len(keys) != 720 {
+			t.Fatalf("expected 720 keys, got %d", len(keys))
+		}
+		for i := 0; i < 800; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%10 == 0 && err != ErrKeyNotFound || i%10 != 0 && err != nil {
+				t.Fatalf("unexpected err %v for key %d", err, i)
+			}
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDB_GroupCommitPartialFailure(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "group-commit-failure")
+	opts.DataFileSize = 1500
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一条数据写满数据文件，切换活跃文件之后磁盘空间不足
+	db.diskAvailable = 1 << 63
+	db.diskWritten = diskCheckBytes - 1
+	db.options.DiskReserveSize = 1 << 62
+	var group []*commitRequest
+	for i := 0; i < 3; i++ {
+		group = append(group, &commitRequest{
+			key: utils.GetTestKey(i),
+			logRecord: &data.LogRecord{
+				Key:   logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeqNo),
+				Value: bytes.Repeat([]byte("a"), 1000),
+			},
+		})
+	}
+	db.writeGroup(group)
+	if group[0].err != nil {
+		t.Fatal(group[0].err)
+	}
+	for _, r := range group[1:] {
+		if r.err != ErrDiskFull {
+			t.Fatalf("expected disk full, got %v", r.err)
+		}
+	}
+	if db.activeFile.WriteOff != db.activeFile.HeaderSize() {
+		t.Fatalf("expected empty active file, write off %d", db.activeFile.WriteOff)
+	}
+
+	check := func(db *DB) {
+		if _, err := db.Get(utils.GetTestKey(0)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < 3; i++ {
+			if _, err := db.Get(utils.GetTestKey(i)); err != ErrKeyNotFound {
+				t.Fatalf("expected key not found, got %v", err)
+			}
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDB_DataHintFile(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "data-hint")
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(db *DB, from, to int, value string) {
+		for i := from; i < to; i++ {
+			if err := db.Put(utils.GetTestKey(i), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reopen := func(db *DB) *DB {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	put(db, 0, 500, "a")
+	db = reopen(db)
+	// 重启之后继续写入活跃文件，hint 文件只覆盖活跃文件的一部分
+	put(db, 250, 500, "b")
+	if err := db.Delete(utils.GetTestKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(data.GetHintFileName(opts.DirPath, 0)); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(db)
+
+	// 损坏的 hint 文件会被忽略，从数据文件中重新加载
+	hintFileName := data.GetHintFileName(opts.DirPath, 1)
+	if err := os.WriteFile(hintFileName, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat := db.Stat()
+	db = reopen(db)
+	defer db.Close()
+
+	if db.Stat().ReclaimableSize != stat.ReclaimableSize {
+		t.Fatalf("unexpected reclaimable size %d, expected %d", db.Stat().ReclaimableSize, stat.ReclaimableSize)
+	}
+	if keys := db.ListKeys(); len(keys) != 499 {
+		t.Fatalf("expected 499 keys, got %d", len(keys))
+	}
+	for i := 1; i < 500; i++ {
+		expected := "a"
+		if i >= 250 {
+			expected = "b"
+		}
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != expected {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+}
+
+func TestDB_ParallelIndexLoad(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "parallel-load")
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 批量写入的数据会跨越多个数据文件
+	for n := 0; n < 5; n++ {
+		wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			if err := wb.Put(utils.GetTestKey(i), []byte(strconv.Itoa(n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := wb.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		for i := n; i < 200; i += 10 {
+			if err := db.Delete(utils.GetTestKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expected := db.Stat()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		// 删除 hint 文件，从数据文件中加载索引
+		hintFiles, err := filepath.Glob(filepath.Join(opts.DirPath, "*"+data.HintFileNameSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hintFile := range hintFiles {
+			if err := os.Remove(hintFile); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		opts.IndexLoadWorkers = workers
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := db.Stat()
+		if stat.KeyNum != expected.KeyNum || stat.ReclaimableSize != expected.ReclaimableSize {
+			t.Fatalf("unexpected stat %+v, expected %+v", stat, expected)
+		}
+		for i := 0; i < 200; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if i%10 == 4 && err != ErrKeyNotFound || i%10 != 4 && (err != nil || string(val) != "4") {
+				t.Fatalf("unexpected value %q, err %v for key %d", val, err, i)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "index-snapshot")
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.DirPath, data.IndexSnapshotFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 快照之后写入的数据在启动时从数据文件中加载
+	for i := 250; i < 600; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(utils.GetTestKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	expected := db.Stat()
+	// 备份的目录中包含上次关闭时的快照，相当于没有正常关闭的数据库
+	backupDir := filepath.Join(t.TempDir(), "index-snapshot-backup")
+	if err := db.Backup(backupDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dirPath string) {
+		opts := opts
+		opts.DirPath = dirPath
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		stat := db.Stat()
+		if stat.KeyNum != expected.KeyNum || stat.ReclaimableSize != expected.ReclaimableSize {
+			t.Fatalf("unexpected stat %+v, expected %+v", stat, expected)
+		}
+		for i := 0; i < 600; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i == 0:
+				if err != ErrKeyNotFound {
+					t.Fatalf("expected deleted key, err %v", err)
+				}
+			case i < 250:
+				if err != nil || string(val) != "a" {
+					t.Fatalf("unexpected value %q, err %v", val, err)
+				}
+			default:
+				if err != nil || string(val) != "b" {
+					t.Fatalf("unexpected value %q, err %v", val, err)
+				}
+			}
+		}
+	}
+	check(backupDir)
+	check(opts.DirPath)
+
+	// 损坏的快照会被忽略，从 hint 文件和数据文件中加载
+	snapshotFileName := filepath.Join(opts.DirPath, data.IndexSnapshotFileName)
+	if err := os.WriteFile(snapshotFileName, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(opts.DirPath)
+
+	// 快照在中途被截断时，丢弃已经分批加载的部分索引
+	opts.DirPath = backupDir
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 600; i < 600+2*indexSnapshotBatchSize; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("c")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected = db.Stat()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backupSnapshot := filepath.Join(backupDir, data.IndexSnapshotFileName)
+	info, err := os.Stat(backupSnapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(backupSnapshot, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if stat := db.Stat(); stat.KeyNum != expected.KeyNum || stat.ReclaimableSize != expected.ReclaimableSize {
+		t.Fatalf("unexpected stat %+v, expected %+v", stat, expected)
+	}
+}
+
+func TestDB_BPlusTreeSeqNoAfterCrash(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "bptree-crash")
+	opts.IndexType = BPlusTree
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wb.Put(utils.GetTestKey(i), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(utils.GetTestKey(10), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	seqNo := db.seqNo
+
+	// 模拟进程崩溃，不保存 seq-no 文件
+	_ = db.activeFile.Close()
+	_ = db.index.Close()
+	_ = db.fileLock.Unlock()
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.seqNo != seqNo {
+		t.Fatalf("expected seq no %d, got %d", seqNo, db.seqNo)
+	}
+	wb, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wb.Put(utils.GetTestKey(11), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if _, err := db.Get(utils.GetTestKey(i)); err != nil {
+			t.Fatalf("unexpected err %v for key %d", err, i)
+		}
+	}
+
+	// 无法恢复事务序列号时批量写入和事务都返回错误
+	db.mu.Lock()
+	db.seqNoFileExists = false
+	db.mu.Unlock()
+	if _, err := db.NewWriteBatch(DefaultWriteBatchOptions); err != ErrSeqNoFileNotExists {
+		t.Fatalf("expected seq no file not exists, got %v", err)
+	}
+	if _, err := db.Begin(); err != ErrSeqNoFileNotExists {
+		t.Fatalf("expected seq no file not exists, got %v", err)
+	}
+}
+
+func TestDB_RebuildBPlusTreeIndex(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "bptree-rebuild")
+	opts.IndexType = BPlusTree
+	opts.MMapAtStartup = false
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := db.Put(utils.GetTestKey(i), utils.RandomValue(64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i += 3 {
+		if err := db.Delete(utils.GetTestKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for i := 0; i < 2000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			if i%3 == 0 && err != ErrKeyNotFound || i%3 != 0 && err != nil {
+				t.Fatalf("unexpected err %v for key %d", err, i)
+			}
+		}
+		if err := db.Put(utils.GetTestKey(2000), []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RebuildIndex(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get(utils.GetTestKey(2000)); err != nil {
+			t.Fatal(err)
+		}
+
+		// 重建索引期间并发读取索引
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 20; i++ {
+				if keys := db.ListKeys(); len(keys) == 0 {
+					t.Error("expected keys")
+				}
+				if err := db.Delete([]byte("missing")); err != nil {
+					t.Error(err)
+				}
+				wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := wb.Delete([]byte("missing")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		for i := 0; i < 5; i++ {
+			if err := db.RebuildIndex(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+	}
+
+	// 索引文件被删除
+	indexFileName := filepath.Join(opts.DirPath, index.BPlusTreeIndexFileName)
+	if err := os.Remove(indexFileName); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// 索引文件损坏
+	if err := os.WriteFile(indexFileName, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestDB_ShardedIndexes(t *testing.T) {
+	for name, typ := range map[string]IndexerType{"hash": Hash, "sharded-btree": ShardedBTree} {
+		t.Run(name, func(t *testing.T) {
+			testShardedIndex(t, typ)
+		})
+	}
+}
+
+func testShardedIndex(t *testing.T, typ IndexerType) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "sharded-index")
+	opts.IndexType = typ
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := n; i < 100; i += 4 {
+				if err := db.Put(utils.GetTestKey(i), []byte(strconv.Itoa(i))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	for i := 0; i < 100; i += 2 {
+		if err := db.Delete(utils.GetTestKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, err := db.Get(utils.GetTestKey(51)); err != nil || string(val) != "51" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+	if _, err := db.Get(utils.GetTestKey(50)); err != ErrKeyNotFound {
+		t.Fatalf("expected key not found, got %v", err)
+	}
+
+	// 遍历时按照 key 的顺序返回
+	for _, reverse := range []bool{false, true} {
+		iter := db.NewIterator(IteratorOptions{Reverse: reverse})
+		var prev []byte
+		var count int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if prev != nil && (bytes.Compare(prev, iter.Key()) >= 0) != reverse {
+				t.Fatalf("keys out of order: %q before %q", prev, iter.Key())
+			}
+			prev = iter.Key()
+			count++
+		}
+		if count != 50 {
+			t.Fatalf("expected 50 keys, got %d", count)
+		}
+		expected := utils.GetTestKey(51)
+		if reverse {
+			expected = utils.GetTestKey(49)
+		}
+		iter.Seek(utils.GetTestKey(50))
+		if !iter.Valid() || !bytes.Equal(iter.Key(), expected) {
+			t.Fatalf("expected seek to %q", expected)
+		}
+		iter.Close()
+	}
+}
+
+func TestDB_IteratorConcurrentWrites(t *testing.T) {
+	for name, typ := range map[string]IndexerType{"btree": BTree, "art": ART} {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			opts.DirPath = filepath.Join(t.TempDir(), "iterator")
+			opts.IndexType = typ
+			db, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 1000; i++ {
+				if err := db.Put(utils.GetTestKey(i*2), []byte("a")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, reverse := range []bool{false, true} {
+				iter := db.NewIterator(IteratorOptions{Reverse: reverse})
+				var count int
+				var prev []byte
+				for iter.Rewind(); iter.Valid(); iter.Next() {
+					// 遍历过程中的写入不影响已有 key 的遍历顺序
+					if count%100 == 0 {
+						if err := db.Put(utils.GetTestKey(count*2+1), []byte("b")); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if prev != nil && (bytes.Compare(prev, iter.Key()) >= 0) != reverse {
+						t.Fatalf("keys out of order: %q before %q", prev, iter.Key())
+					}
+					// 只统计创建迭代器之前写入的偶数 key
+					if key := iter.Key(); (key[len(key)-1]-'0')%2 == 0 {
+						count++
+					}
+					if _, err := iter.Value(); err != nil {
+						t.Fatal(err)
+					}
+					prev = append(prev[:0], iter.Key()...)
+				}
+				if count != 1000 {
+					t.Fatalf("expected 1000 keys, got %d", count)
+				}
+				iter.Seek(utils.GetTestKey(999))
+				if !iter.Valid() {
+					t.Fatal("expected seek to find a key")
+				}
+				iter.Close()
+			}
+
+			// 遍历过程中被删除的 key 仍然可以读取到遍历到它时的 value
+			iter := db.NewIterator(DefaultIteratorOptions)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				if err := db.Delete(iter.Key()); err != nil {
+					t.Fatal(err)
+				}
+				if val, err := iter.Value(); err != nil || len(val) != 1 {
+					t.Fatalf("unexpected value %q for deleted key %q, err %v", val, iter.Key(), err)
+				}
+			}
+			iter.Close()
+			if keys := db.ListKeys(); len(keys) != 0 {
+				t.Fatalf("expected all keys deleted, got %d", len(keys))
+			}
+		})
+	}
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "compression")
+	opts.Compression = Deflate
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(strings.Repeat(`{"id":1,"name":"scache"}`, 100))
+	for i := 0; i < 100; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 小于阈值的 value 不压缩
+	if err := db.Put([]byte("small"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if size := db.Stat().DiskSize; size >= int64(100*len(value)) {
+		t.Fatalf("expected compressed data, disk size %d", size)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 关闭压缩之后旧数据仍然可以读取，merge 时解压重写
+	opts.Compression = NoCompression
+	opts.DataFileMergeRatio = 0
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check := func() {
+		for i := 0; i < 100; i++ {
+			if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+				t.Fatalf("unexpected value for key %d, err %v", i, err)
+			}
+		}
+		if val, err := db.Get([]byte("small")); err != nil || string(val) != "v" {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+	check()
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if size := db.Stat().DiskSize; size < int64(100*len(value)) {
+		t.Fatalf("expected uncompressed data after merge, disk size %d", size)
+	}
+}
+
+func TestDB_RepairCompressed(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "src")
+	opts.Compression = Deflate
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte(strings.Repeat("compressible value ", 80))
+	for i := 0; i < 10; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 被覆盖之后过期的数据在修复之后不能恢复为旧的值
+	if err := db.Put([]byte("ttl"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL([]byte("ttl"), []byte("v2"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	destDir := filepath.Join(t.TempDir(), "dest")
+	if _, err := Repair(opts.DirPath, destDir); err != nil {
+		t.Fatal(err)
+	}
+	destOpts := DefaultOptions
+	destOpts.DirPath = destDir
+	destDB, err := Open(destOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destDB.Close()
+	for i := 0; i < 10; i++ {
+		val, err := destDB.Get(utils.GetTestKey(i))
+		if err != nil || !bytes.Equal(val, value) {
+			t.Fatalf("unexpected value of %d bytes, err %v", len(val), err)
+		}
+	}
+	if val, err := destDB.Get([]byte("ttl")); err != ErrKeyNotFound {
+		t.Fatalf("expected expired key not found, got %q, err %v", val, err)
+	}
+}
+
+func TestDB_Verify(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "verify")
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Put(utils.GetTestKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 检查过程不会修改数据目录
+	listDir := func() map[string]int64 {
+		entries, err := os.ReadDir(opts.DirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]int64)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[entry.Name()] = info.Size()
+		}
+		return files
+	}
+	verify := func() *VerifyReport {
+		before := listDir()
+		report, err := Verify(opts.DirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := listDir()
+		if len(after) != len(before) {
+			t.Fatalf("verify changed the directory: %v -> %v", before, after)
+		}
+		for name, size := range before {
+			if after[name] != size {
+				t.Fatalf("verify changed file %s: %d -> %d", name, size, after[name])
+			}
+		}
+		return report
+	}
+	hasProblem := func(report *VerifyReport, fileName string, kind VerifyProblemKind) bool {
+		for _, problem := range report.Problems {
+			if problem.FileName == fileName && problem.Kind == kind {
+				return true
+			}
+		}
+		return false
+	}
+
+	report := verify()
+	if !report.OK() {
+		t.Fatalf("unexpected problems %v", report.Problems)
+	}
+	var hintFiles int
+	for _, file := range report.Files {
+		if strings.HasSuffix(file.FileName, data.HintFileNameSuffix) {
+			hintFiles++
+		}
+	}
+	if hintFiles == 0 {
+		t.Fatal("expected per data file hint files to be verified")
+	}
+
+	// 没有写完整的 hint 文件和旧格式的数据文件作为问题报告
+	hintFileName := data.GetHintFileName(opts.DirPath, 0)
+	stat, err := os.Stat(hintFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(hintFileName, stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	dataFileName := data.GetDataFileName(opts.DirPath, 1)
+	file, err := os.OpenFile(dataFileName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(make([]byte, data.FileHeaderSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	report = verify()
+	if !hasProblem(report, filepath.Base(hintFileName), ProblemTornRecord) {
+		t.Fatalf("expected torn hint file, got %v", report.Problems)
+	}
+	if !hasProblem(report, filepath.Base(dataFileName), ProblemInvalidFile) {
+		t.Fatalf("expected invalid data file header, got %v", report.Problems)
+	}
+	if !hasProblem(report, filepath.Base(data.GetHintFileName(opts.DirPath, 1)), ProblemDanglingHint) {
+		t.Fatalf("expected dangling hint for the invalid data file, got %v", report.Problems)
+	}
+}
+
+type testKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+func (p *testKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *testKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, data.ErrInvalidCiphertext
+	}
+	return key, nil
+}
+
+func TestDB_Encryption(t *testing.T) {
+	provider := &testKeyProvider{current: 1, keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "encryption")
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.KeyProvider = provider
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte("plaintext-value")
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(opts.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join(opts.DirPath, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, value) || bytes.Contains(raw, utils.GetTestKey(1)) {
+			t.Fatalf("plaintext found in %s", entry.Name())
+		}
+	}
+
+	// 轮换密钥，merge 之后不再需要旧的密钥
+	provider.keys[2] = bytes.Repeat([]byte{2}, 32)
+	provider.current = 2
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 2000; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	delete(provider.keys, 1)
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+			t.Fatalf("unexpected value for key %d, err %v", i, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 检查和修复加密的数据目录需要指定密钥提供者
+	report, err := Verify(opts.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("expected encrypted records to be reported without a key provider")
+	}
+	verifyOpts := VerifyOptions{KeyProvider: provider}
+	if report, err = VerifyWithOptions(opts.DirPath, verifyOpts); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems %v", report.Problems)
+	}
+	destOpts := opts
+	destOpts.DirPath = filepath.Join(t.TempDir(), "encryption-repair")
+	if _, err := RepairWithOptions(opts.DirPath, destOpts.DirPath, verifyOpts); err != nil {
+		t.Fatal(err)
+	}
+	destDB, err := Open(destOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if val, err := destDB.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+			t.Fatalf("unexpected repaired value for key %d, err %v", i, err)
+		}
+	}
+	if err := destDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未加密的 B+ 树索引在开启加密之后重建，遍历的结果仍然有序
+	opts.DirPath = filepath.Join(t.TempDir(), "encryption-bptree")
+	opts.IndexType = BPlusTree
+	opts.KeyProvider = nil
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put(utils.GetTestKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.KeyProvider = provider
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.index.(*index.BPlusTree).Encrypted() {
+		t.Fatal("expected encrypted bptree index")
+	}
+	if err := db.Delete(utils.GetTestKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	keys := db.ListKeys()
+	if len(keys) != 99 {
+		t.Fatalf("expected 99 keys, got %d", len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("keys are not sorted at %d", i)
+		}
+	}
+	if val, err := db.Get(utils.GetTestKey(50)); err != nil || string(val) != string(value) {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+
+	// 没有新的写入时复用排序之后的缓存，反向遍历不影响缓存的顺序
+	reverseOpts := DefaultIteratorOptions
+	reverseOpts.Reverse = true
+	iter := db.NewIterator(reverseOpts)
+	iter.Rewind()
+	if !iter.Valid() || !bytes.Equal(iter.Key(), keys[len(keys)-1]) {
+		t.Fatalf("unexpected first key in reverse iterator")
+	}
+	iter.Close()
+	if cached := db.ListKeys(); len(cached) != 99 || !bytes.Equal(cached[0], keys[0]) {
+		t.Fatalf("unexpected keys from cached view")
+	}
+	if err := db.Put([]byte("new-key"), value); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db.ListKeys(); len(keys) != 100 {
+		t.Fatalf("expected 100 keys after put, got %d", len(keys))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读打开的加密 B+ 树索引同样可以检查
+	if report, err = VerifyWithOptions(opts.DirPath, verifyOpts); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("unexpected problems %v", report.Problems)
+	}
+	var bptreeRecords int
+	for _, file := range report.Files {
+		if file.FileName == index.BPlusTreeIndexFileName {
+			bptreeRecords = file.Records
+		}
+	}
+	if bptreeRecords != 100 {
+		t.Fatalf("expected 100 bptree index records, got %d", bptreeRecords)
+	}
+}
+
+// 按照升级之前的格式编码记录：头部没有过期时间，使用 CRC32 校验
+func encodeLegacyLogRecord(key []byte, value []byte, typ data.LogRecordType) []byte {
+	buf := make([]byte, 5+binary.MaxVarintLen32*2+len(key)+len(value))
+	buf[4] = typ
+	n := 5
+	n += binary.PutVarint(buf[n:], int64(len(key)))
+	n += binary.PutVarint(buf[n:], int64(len(value)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], value)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:n]))
+	return buf[:n]
+}
+
+// 按照升级之前的格式写一个数据目录，返回每个 key 期望的 value
+func writeLegacyDir(t *testing.T, dirPath string) map[string]string {
+	expected := make(map[string]string)
+	files := make(map[string][]byte)
+	put := func(name string, key []byte, value []byte, typ data.LogRecordType) (int64, int) {
+		offset := int64(len(files[name]))
+		record := encodeLegacyLogRecord(key, value, typ)
+		files[name] = append(files[name], record...)
+		return offset, len(record)
+	}
+	mergePath := dirPath + mergeDirName
+	oldFile := filepath.Join(dirPath, "000000000.data")
+	mergedFile := filepath.Join(mergePath, "000000000.data")
+	mergeHint := filepath.Join(mergePath, data.HintFileName)
+
+	// 已经完成但还没有安装的 merge，旧的 0 号文件会被 merge 目录中的文件替换
+	for i := 0; i < 300; i++ {
+		key := utils.GetTestKey(i)
+		value := "merged-" + strconv.Itoa(i)
+		put(oldFile, logRecordKeyWithSeq(key, nonTransactionSeqNo), []byte("stale"), data.LogRecordNormal)
+		put(oldFile, logRecordKeyWithSeq(key, nonTransactionSeqNo), []byte(value), data.LogRecordNormal)
+		offset, size := put(mergedFile, logRecordKeyWithSeq(key, nonTransactionSeqNo), []byte(value), data.LogRecordNormal)
+		pos := make([]byte, binary.MaxVarintLen32*3)
+		n := binary.PutVarint(pos, 0)
+		n += binary.PutVarint(pos[n:], offset)
+		n += binary.PutVarint(pos[n:], int64(size))
+		put(mergeHint, key, pos[:n], data.LogRecordNormal)
+		expected[string(key)] = value
+	}
+	put(filepath.Join(mergePath, data.MergeFinishedFileName), []byte(mergeFinishedKey), []byte("1"), data.LogRecordNormal)
+
+	file1 := filepath.Join(dirPath, "000000001.data")
+	for i := 300; i < 600; i++ {
+		value := "v1-" + strconv.Itoa(i) + strings.Repeat("x", 100)
+		put(file1, logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeqNo), []byte(value), data.LogRecordNormal)
+		expected[string(utils.GetTestKey(i))] = value
+	}
+	for i := 0; i < 50; i++ {
+		put(file1, logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeqNo), nil, data.LogRecordDeleted)
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	// 提交完成的事务和没有提交完成的事务
+	for i := 600; i < 610; i++ {
+		value := "txn-" + strconv.Itoa(i)
+		put(file1, logRecordKeyWithSeq(utils.GetTestKey(i), 5), []byte(value), data.LogRecordNormal)
+		expected[string(utils.GetTestKey(i))] = value
+	}
+	put(file1, logRecordKeyWithSeq(txnFinKey, 5), nil, data.LogRecordTxnFinished)
+	put(file1, logRecordKeyWithSeq(utils.GetTestKey(610), 6), []byte("uncommitted"), data.LogRecordNormal)
+
+	file2 := filepath.Join(dirPath, "000000002.data")
+	for i := 300; i < 350; i++ {
+		value := "v2-" + strconv.Itoa(i)
+		put(file2, logRecordKeyWithSeq(utils.GetTestKey(i), nonTransactionSeqNo), []byte(value), data.LogRecordNormal)
+		expected[string(utils.GetTestKey(i))] = value
+	}
+	// 进程崩溃留下的不完整的记录
+	torn := encodeLegacyLogRecord(logRecordKeyWithSeq(utils.GetTestKey(700), nonTransactionSeqNo), []byte("torn"), data.LogRecordNormal)
+	files[file2] = append(files[file2], torn[:len(torn)-2]...)
+	put(filepath.Join(dirPath, data.SeqNoFileName), []byte(seqNoKey), []byte("6"), data.LogRecordNormal)
+
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return expected
+}
+
+func TestDB_UpgradeLegacyFormat(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "upgrade")
+	expected := writeLegacyDir(t, opts.DirPath)
+	// 在副本上打开，打开失败之前会丢弃没有安装的 merge 结果
+	legacyOpts := opts
+	legacyOpts.DirPath = filepath.Join(t.TempDir(), "legacy")
+	if err := utils.CopyDir(opts.DirPath, legacyOpts.DirPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(legacyOpts); !errors.Is(err, ErrLegacyFileFormat) {
+		t.Fatalf("expected ErrLegacyFileFormat, got %v", err)
+	}
+
+	if err := Upgrade(opts.DirPath); err != nil {
+		t.Fatal(err)
+	}
+	// 重复升级不会修改已经升级的文件
+	if err := Upgrade(opts.DirPath); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *DB) {
+		if keys := db.ListKeys(); len(keys) != len(expected) {
+			t.Fatalf("expected %d keys, got %d", len(expected), len(keys))
+		}
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			if err != nil || string(val) != value {
+				t.Fatalf("key %s: unexpected value %q, err %v", key, val, err)
+			}
+		}
+	}
+	for _, indexType := range []IndexerType{BTree, BPlusTree} {
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := Verify(opts.DirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只有没有提交完成的事务
+	if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemUncommittedTxn {
+		t.Fatalf("unexpected problems after upgrade: %v", report.Problems)
+	}
+
+	// 不支持的文件格式版本
+	header := data.NewFileHeader(data.DataFileType, 1000, CRC32C)
+	header.Version = data.FileFormatVersion + 1
+	fileName := data.GetDataFileName(opts.DirPath, 1000)
+	if err := os.WriteFile(fileName, data.EncodeFileHeader(header), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(opts); !errors.Is(err, ErrUnsupportedFileVersion) {
+		t.Fatalf("expected ErrUnsupportedFileVersion, got %v", err)
+	}
+}
+
+func TestDB_Checksums(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "checksums")
+	opts.Checksum = CRC32
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("crc32"), []byte("value-crc32")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 修改校验算法之后旧的文件仍然使用原来的算法，新的写入进入新的活跃文件
+	opts.Checksum = CRC32C
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("crc32c"), []byte("value-crc32c")); err != nil {
+		t.Fatal(err)
+	}
+	oldFile := db.olderFiles[0]
+	if oldFile == nil || oldFile.Checksum() != CRC32 || db.activeFile.Checksum() != CRC32C {
+		t.Fatal("unexpected data file checksums")
+	}
+	for _, key := range []string{"crc32", "crc32c"} {
+		if val, err := db.Get([]byte(key)); err != nil || string(val) != "value-"+key {
+			t.Fatalf("unexpected value %q, err %v", val, err)
+		}
+	}
+
+	// 损坏旧文件中的 value，只有开启读取校验时才能发现
+	pos := db.index.Get([]byte("crc32"))
+	file, err := os.OpenFile(data.GetDataFileName(opts.DirPath, pos.Fid), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("X"), pos.Offset+int64(pos.Size)-1); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+	if _, err := db.Get([]byte("crc32")); err != data.ErrInvalidCRC {
+		t.Fatalf("expected ErrInvalidCRC, got %v", err)
+	}
+	db.options.VerifyChecksums = VerifyOnStartupAndMerge
+	if val, err := db.Get([]byte("crc32")); err != nil || string(val) != "value-crc3X" {
+		t.Fatalf("unexpected value %q, err %v", val, err)
+	}
+}
+
+func TestDB_MMapIO(t *testing.T) {
+	opts := DefaultOptions
+	opts.DirPath = filepath.Join(t.TempDir(), "mmap")
+	opts.DataFileSize = 64 * 1024
+	opts.ActiveFileIOType = MMapIO
+	opts.OlderFileIOType = MMapIO
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	put := func(start, end int) {
+		for i := start; i < end; i++ {
+			if err := db.Put(utils.GetTestKey(i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(end int) {
+		for i := 0; i < end; i++ {
+			if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+				t.Fatalf("unexpected value for key %d, err %v", i, err)
+			}
+		}
+	}
+	put(0, 2000)
+	check(2000)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// 写满的活跃文件截断到实际写入的大小
+	if len(db.olderFiles) == 0 {
+		t.Fatal("expected sealed data files")
+	}
+	for fid, file := range db.olderFiles {
+		if stat, err := os.Stat(data.GetDataFileName(opts.DirPath, fid)); err != nil || stat.Size() != file.WriteOff {
+			t.Fatalf("expected data file %d truncated to %d, err %v", fid, file.WriteOff, err)
+		}
+	}
+	// 活跃文件预先扩展到 DataFileSize
+	activeFileName := data.GetDataFileName(opts.DirPath, db.activeFile.FileId)
+	writeOff := db.activeFile.WriteOff
+	if stat, err := os.Stat(activeFileName); err != nil || stat.Size() != opts.DataFileSize {
+		t.Fatalf("expected preallocated active file, err %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(activeFileName); err != nil || stat.Size() != writeOff {
+		t.Fatalf("expected active file truncated to %d, err %v", writeOff, err)
+	}
+
+	// 没有正常关闭时活跃文件和旧的数据文件末尾是全 0 的数据，启动时截断
+	olderFileName := data.GetDataFileName(opts.DirPath, 0)
+	olderStat, err := os.Stat(olderFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range []string{activeFileName, olderFileName} {
+		if err := os.Truncate(fileName, opts.DataFileSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.StrictRecovery = true
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(2000)
+	if stat, err := os.Stat(olderFileName); err != nil || stat.Size() != olderStat.Size() {
+		t.Fatalf("expected older data file truncated to %d, err %v", olderStat.Size(), err)
+	}
+	put(2000, 2100)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.MMapAtStartup = false
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(2100)
+
+	// 超过预先扩展大小的记录会扩大映射的范围
+	bigValue := bytes.Repeat([]byte("b"), int(opts.DataFileSize)*2)
+	if err := db.Put([]byte("big"), bigValue); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := db.Get([]byte("big")); err != nil || !bytes.Equal(val, bigValue) {
+		t.Fatalf("unexpected big value, err %v", err)
+	}
+
+	// 选择性 merge 重写之后的文件同样使用 OlderFileIOType
+	for i := 0; i < 2000; i++ {
+		if err := db.Delete(utils.GetTestKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.options.MergeMode = MergeSelective
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.olderFiles[0].IoManager.(*fio.MMapRW); !ok {
+		t.Fatalf("unexpected io manager %T for compacted data file", db.olderFiles[0].IoManager)
+	}
+	for i := 2000; i < 2100; i++ {
+		if val, err := db.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+			t.Fatalf("unexpected value for key %d, err %v", i, err)
+		}
+	}
+
+	// 写入失败时截断活跃文件会替换 IoManager，快照不持有数据库的锁读取数据
+	put(3000, 3100)
+	snap := db.Snapshot()
+	defer snap.Release()
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for n := 0; n < 20; n++ {
+			for i := 3000; i < 3100; i++ {
+				if val, err := snap.Get(utils.GetTestKey(i)); err != nil || string(val) != string(value) {
+					errs <- fmt.Errorf("unexpected snapshot value for key %d, err %v", i, err)
+					return
+				}
+			}
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+			reading = false
+		default:
+			db.mu.Lock()
+			err := db.activeFile.Truncate(opts.DirPath, db.activeFile.WriteOff, db.options.ActiveFileIOType)
+			db.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package scache
 
-import "errors"
+import (
+	"errors"
+	"github.com/sharch/scache/data"
+)
 
 var (
 	ErrKeyIsEmpty             = errors.New("the key is empty")
@@ -13,4 +16,15 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrMergeNotInstalled      = errors.New("the last merge was not installed, reopen the database to finish it")
+	ErrDiskFull               = errors.New("no enough disk space, the database is read only now")
+	ErrInvalidMergeRate       = errors.New("the merge bytes per second must not be negative")
+	ErrIndexInUse             = errors.New("the index is used by snapshots or iterators, release them and try again")
+	ErrInvalidTTL             = errors.New("the ttl must not be negative")
+	ErrSnapshotReleased       = errors.New("the snapshot has been released")
+	ErrTxnConflict            = errors.New("transaction conflict, the keys read have been modified")
+	ErrTxnClosed              = errors.New("the transaction has been committed or rolled back")
+	ErrSeqNoFileNotExists     = errors.New("cannot use transaction, seq no file not exists")
+	ErrLegacyFileFormat       = data.ErrLegacyFileFormat
+	ErrUnsupportedFileVersion = data.ErrUnsupportedFileVersion
 )
@@ -0,0 +1,22 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// 为文件的前 size 个字节分配磁盘空间，文件小于 size 时扩展文件
+// 文件系统不支持 fallocate 时逐个块写入数据
+func allocate(fd *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(fd.Fd()), 0, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return allocateByWrite(fd, size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package fio
+
+import "os"
+
+// 为文件的前 size 个字节分配磁盘空间，文件小于 size 时扩展文件
+func allocate(fd *os.File, size int64) error {
+	return allocateByWrite(fd, size)
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package fio
+
+import "os"
+
+// 分配磁盘空间时写入的块大小，和常见文件系统的块大小一致
+const allocateBlockSize = 4096
+
+// 将文件扩展到 size 之后，在扩展部分的每个块中写入一个字节，让文件系统实际分配磁盘空间
+// 和 posix_fallocate 的兜底实现相同，磁盘空间不足时写入会返回 ENOSPC
+func allocateByWrite(fd *os.File, size int64) error {
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	start := stat.Size()
+	if size <= start {
+		return nil
+	}
+	if err := fd.Truncate(size); err != nil {
+		return err
+	}
+	zero := []byte{0}
+	for offset := start; offset < size; offset = (offset/allocateBlockSize + 1) * allocateBlockSize {
+		if _, err := fd.WriteAt(zero, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
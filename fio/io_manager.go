@@ -8,8 +8,11 @@ const (
 	// StandardFIO 标准文件 IO
 	StandardFIO FileIOType = iota
 
-	// MemoryMap 内存文件映射
+	// MemoryMap 只读的内存文件映射，只用于启动时加载数据
 	MemoryMap
+
+	// MemoryMapRW 可读写的内存文件映射
+	MemoryMapRW
 )
 
 // IOManager 抽象 IO 管理接口，可以接入不同的 IO 类型，目前支持标准文件 IO
@@ -30,13 +33,15 @@ type IOManager interface {
 	Size() (int64, error)
 }
 
-// NewIOManager 初始化 IOManager，目前只支持标准 FileIO
-func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
+// NewIOManager 初始化 IOManager，preallocSize 是可读写的内存文件映射预先扩展的文件大小
+func NewIOManager(fileName string, ioType FileIOType, preallocSize int64) (IOManager, error) {
 	switch ioType {
 	case StandardFIO:
 		return NewFileIOManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case MemoryMapRW:
+		return NewMMapRWIOManager(fileName, preallocSize)
 	default:
 		panic("unsupported io type")
 	}
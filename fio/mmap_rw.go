@@ -0,0 +1,128 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// MMapRW 可读写的内存文件映射，打开时将文件预先扩展到指定的大小，写入时直接拷贝到映射的内存中
+// 文件末尾预先扩展的部分全部为 0，关闭时截断到实际写入的大小
+type MMapRW struct {
+	fd   *os.File
+	mu   *sync.RWMutex
+	data []byte // 映射的内存，长度就是文件当前的大小
+	size int64  // 实际写入的数据大小
+}
+
+// NewMMapRWIOManager 初始化可读写的 MMap IO，文件小于 preallocSize 时扩展到 preallocSize
+func NewMMapRWIOManager(fileName string, preallocSize int64) (*MMapRW, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	mmap := &MMapRW{fd: fd, mu: new(sync.RWMutex), size: stat.Size()}
+	capacity := stat.Size()
+	if preallocSize > capacity {
+		capacity = preallocSize
+	}
+	if err := mmap.remap(capacity); err != nil {
+		// 磁盘空间不足时去掉已经扩展的部分
+		_ = fd.Truncate(stat.Size())
+		_ = fd.Close()
+		return nil, err
+	}
+	return mmap, nil
+}
+
+// 重新映射文件，文件会被扩展到 capacity 的大小
+// 扩展的部分会实际分配磁盘空间，磁盘空间不足时在这里返回错误，而不是在写入映射的内存时触发 SIGBUS
+func (mmap *MMapRW) remap(capacity int64) error {
+	if mmap.data != nil {
+		if err := munmap(mmap.data); err != nil {
+			return err
+		}
+		mmap.data = nil
+	}
+	if err := allocate(mmap.fd, capacity); err != nil {
+		return err
+	}
+	if capacity == 0 {
+		return nil
+	}
+	data, err := mmapFile(mmap.fd, capacity)
+	if err != nil {
+		return err
+	}
+	mmap.data = data
+	return nil
+}
+
+func (mmap *MMapRW) Read(b []byte, offset int64) (int, error) {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	if offset >= mmap.size {
+		return 0, io.EOF
+	}
+	n := copy(b, mmap.data[offset:mmap.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mmap *MMapRW) Write(b []byte) (int, error) {
+	mmap.mu.Lock()
+	defer mmap.mu.Unlock()
+	// 写入的数据超出了映射的范围，扩大一倍之后重新映射
+	end := mmap.size + int64(len(b))
+	if end > int64(len(mmap.data)) {
+		capacity := int64(len(mmap.data)) * 2
+		if capacity < end {
+			capacity = end
+		}
+		if err := mmap.remap(capacity); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(mmap.data[mmap.size:], b)
+	mmap.size += int64(n)
+	return n, nil
+}
+
+func (mmap *MMapRW) Sync() error {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	if mmap.size == 0 {
+		return nil
+	}
+	return msync(mmap.fd, mmap.data[:mmap.size])
+}
+
+func (mmap *MMapRW) Close() error {
+	mmap.mu.Lock()
+	defer mmap.mu.Unlock()
+	if mmap.data != nil {
+		if err := munmap(mmap.data); err != nil {
+			return err
+		}
+		mmap.data = nil
+	}
+	// 去掉末尾预先扩展的部分
+	if err := mmap.fd.Truncate(mmap.size); err != nil {
+		_ = mmap.fd.Close()
+		return err
+	}
+	return mmap.fd.Close()
+}
+
+func (mmap *MMapRW) Size() (int64, error) {
+	mmap.mu.RLock()
+	defer mmap.mu.RUnlock()
+	return mmap.size, nil
+}
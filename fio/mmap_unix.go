@@ -0,0 +1,22 @@
+//go:build !windows
+
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// 以可读写的方式映射文件的前 size 个字节
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(fd.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
+
+// 将映射内存中修改的数据持久化到磁盘
+func msync(_ *os.File, data []byte) error {
+	return unix.Msync(data, unix.MS_SYNC)
+}
@@ -0,0 +1,49 @@
+//go:build windows
+
+package fio
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+	"unsafe"
+)
+
+// 将文件扩展到 size 的大小，NTFS 上不是稀疏文件的扩展部分会实际分配磁盘空间，空间不足时返回错误
+func allocate(fd *os.File, size int64) error {
+	stat, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if size <= stat.Size() {
+		return nil
+	}
+	return fd.Truncate(size)
+}
+
+// 以可读写的方式映射文件的前 size 个字节
+func mmapFile(fd *os.File, size int64) ([]byte, error) {
+	handle, err := windows.CreateFileMapping(windows.Handle(fd.Fd()), nil, windows.PAGE_READWRITE,
+		uint32(size>>32), uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	// 映射的视图会保持对文件映射对象的引用，可以直接关闭句柄
+	addr, err := windows.MapViewOfFile(handle, windows.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	_ = windows.CloseHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(nil, addr)), size), nil
+}
+
+func munmap(data []byte) error {
+	return windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0])))
+}
+
+// 将映射内存中修改的数据持久化到磁盘，FlushViewOfFile 不会刷新文件的元数据，需要再调用一次 Sync
+func msync(fd *os.File, data []byte) error {
+	if err := windows.FlushViewOfFile(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data))); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
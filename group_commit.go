@@ -0,0 +1,80 @@
+package scache
+
+import "github.com/sharch/scache/data"
+
+// 等待组提交的一次写入
+type commitRequest struct {
+	key       []byte // 写入并持久化之后需要更新索引的 key
+	logRecord *data.LogRecord
+	err       error
+	lead      bool          // 被唤醒之后是否作为 leader 进行下一组提交
+	done      chan struct{} // 写入完成或者成为 leader 时关闭
+}
+
+// 组提交，并发的写入进入等待队列，由 leader 将队列中的数据合并为一次写入并只持久化一次
+// leader 写入完成之后唤醒同组的写入，并将 leader 交给队列中等待的下一个写入
+func (db *DB) groupCommit(key []byte, logRecord *data.LogRecord) error {
+	req := &commitRequest{
+		key:       key,
+		logRecord: logRecord,
+		done:      make(chan struct{}),
+	}
+
+	db.commitMu.Lock()
+	db.commitQueue = append(db.commitQueue, req)
+	if db.committing {
+		db.commitMu.Unlock()
+		<-req.done
+		if !req.lead {
+			return req.err
+		}
+		db.commitMu.Lock()
+	}
+	db.committing = true
+	group := db.commitQueue
+	db.commitQueue = nil
+	db.commitMu.Unlock()
+
+	db.writeGroup(group)
+
+	// 唤醒同组的写入，队列中还有等待的写入则由第一个成为新的 leader
+	db.commitMu.Lock()
+	if len(db.commitQueue) > 0 {
+		next := db.commitQueue[0]
+		next.lead = true
+		close(next.done)
+	} else {
+		db.committing = false
+	}
+	db.commitMu.Unlock()
+	for _, r := range group {
+		if r != req {
+			close(r.done)
+		}
+	}
+	return req.err
+}
+
+// 将一组写入追加到活跃文件中，持久化之后批量更新内存索引
+// 中途写入失败时，已经持久化的写入正常更新索引，之后的写入返回错误
+func (db *DB) writeGroup(group []*commitRequest) {
+	keys := make([][]byte, len(group))
+	logRecords := make([]*data.LogRecord, len(group))
+	for i, r := range group {
+		keys[i] = r.key
+		logRecords[i] = r.logRecord
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	positions, err := db.appendLogRecords(logRecords)
+	errs := db.applyWrites(keys[:len(positions)], logRecords[:len(positions)], positions)
+	for i, r := range group {
+		if i < len(positions) {
+			r.err = errs[i]
+		} else {
+			r.err = err
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package scache
+
+import (
+	"errors"
+	"github.com/sharch/scache/data"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// 单个数据文件的 hint 文件的最后一条记录，记录 hint 文件覆盖的数据文件大小
+const hintFinishedKey = "hint.finished"
+
+var errInvalidDataHint = errors.New("invalid data hint file")
+
+// 单个数据文件的 hint 文件中的一条记录，对应数据文件中的一条记录
+type hintEntry struct {
+	key []byte // 数据文件中原始的 key，带有事务序列号
+	typ data.LogRecordType
+	pos *data.LogRecordPos
+}
+
+// 是否需要维护单个数据文件的 hint 文件，B+ 树索引不需要从数据文件中加载索引
+func (db *DB) dataHintEnabled() bool {
+	return db.options.IndexType != BPlusTree
+}
+
+// 将活跃文件转换为旧的数据文件，并打开新的活跃文件
+// 在访问此方法前必须持有互斥锁
+func (db *DB) rotateActiveFile() error {
+	// 先持久化数据文件，保证已有的数据持久到磁盘当中
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+
+	// 打开新的数据文件，失败时原来的活跃文件和暂存的 hint 记录继续使用
+	activeFile, activeHint := db.activeFile, db.activeHint
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+	db.activeHint = nil
+	db.sealDataHint(activeFile, activeHint)
+
+	// 原来的活跃文件转换为旧的数据文件
+	db.olderFiles[activeFile.FileId] = activeFile
+	if db.options.ActiveFileIOType != StandardIO || db.options.OlderFileIOType != StandardIO {
+		db.sealedFiles = append(db.sealedFiles, &staleFile{file: activeFile, gen: db.fileGen})
+		db.nextFileGen()
+	}
+	return db.reopenSealedFiles(db.minPinnedFileGen())
+}
+
+// 写满的活跃文件截断预先扩展的部分，并使用旧数据文件的 IO 类型重新打开
+// 快照、迭代器和 merge 引用数据文件期间不能替换文件句柄，引用写满之前版本的读取都释放之后再处理
+// 在访问此方法前必须持有互斥锁
+func (db *DB) reopenSealedFiles(minGen uint64) error {
+	var sealedFiles []*staleFile
+	for i, sealed := range db.sealedFiles {
+		if sealed.gen >= minGen {
+			sealedFiles = append(sealedFiles, sealed)
+			continue
+		}
+		// 已经被 merge 替换的文件不需要处理
+		if db.olderFiles[sealed.file.FileId] != sealed.file {
+			continue
+		}
+		if err := sealed.file.Seal(db.options.DirPath, db.options.OlderFileIOType); err != nil {
+			db.sealedFiles = append(sealedFiles, db.sealedFiles[i:]...)
+			return err
+		}
+	}
+	db.sealedFiles = sealedFiles
+	return nil
+}
+
+// 为当前活跃文件写 hint 文件，hint 文件只用于加快启动速度，写入失败不影响数据
+// 在访问此方法前必须持有互斥锁
+func (db *DB) sealActiveHint() {
+	db.sealDataHint(db.activeFile, db.activeHint)
+	db.activeHint = nil
+}
+
+// 为写满的数据文件写 hint 文件，entries 为数据文件中所有记录对应的 hint 记录
+func (db *DB) sealDataHint(dataFile *data.DataFile, entries []byte) {
+	if !db.dataHintEnabled() || dataFile == nil {
+		return
+	}
+	fileId := dataFile.FileId
+	if err := writeDataHintFile(db.options.DirPath, fileId, db.options.Checksum, entries, dataFile.WriteOff); err != nil {
+		log.Printf("failed to write hint file for data file %d: %v\n", fileId, err)
+		_ = os.Remove(data.GetHintFileName(db.options.DirPath, fileId))
+	}
+}
+
+// 写单个数据文件的 hint 文件，size 表示 hint 文件覆盖的数据文件大小，entries 需要使用 checksum 指定的校验算法编码
+func writeDataHintFile(dirPath string, fileId uint32, checksum data.ChecksumType, entries []byte, size int64) error {
+	hintFileName := data.GetHintFileName(dirPath, fileId)
+	if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(dirPath, fileId, checksum)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	finRecord, _ := data.EncodeLogRecordWithChecksum(&data.LogRecord{
+		Key:   []byte(hintFinishedKey),
+		Value: []byte(strconv.FormatInt(size, 10)),
+	}, hintFile.Checksum())
+	if err := hintFile.Write(append(entries, finRecord...)); err != nil {
+		return err
+	}
+	return hintFile.Sync()
+}
+
+// 读取单个数据文件的 hint 文件，返回其中的记录和覆盖的数据文件大小
+// hint 文件不存在、校验失败或者没有写完整时返回错误，需要从数据文件中加载索引
+func readDataHintFile(dirPath string, fileId uint32, cipher *data.Cipher) ([]*hintEntry, int64, error) {
+	hintFileName := data.GetHintFileName(dirPath, fileId)
+	if _, err := os.Stat(hintFileName); err != nil {
+		return nil, 0, err
+	}
+	hintFile, err := data.OpenDataHintFile(dirPath, fileId, data.ChecksumCRC32)
+	if err != nil {
+		return nil, 0, err
+	}
+	hintFile.Cipher = cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var entries []*hintEntry
+	var finRecord *data.LogRecord
+	offset := hintFile.HeaderSize()
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, err
+		}
+		offset += size
+		// 最后一条记录标识 hint 文件已经写完整
+		if finRecord != nil {
+			return nil, 0, errInvalidDataHint
+		}
+		if string(logRecord.Key) == hintFinishedKey {
+			finRecord = logRecord
+			continue
+		}
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if pos.Fid != fileId {
+			return nil, 0, errInvalidDataHint
+		}
+		entries = append(entries, &hintEntry{
+			key: logRecord.Key,
+			typ: logRecord.Type,
+			pos: pos,
+		})
+	}
+	if finRecord == nil {
+		return nil, 0, errInvalidDataHint
+	}
+	size, err := strconv.ParseInt(string(finRecord.Value), 10, 64)
+	if err != nil {
+		return nil, 0, errInvalidDataHint
+	}
+	return entries, size, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	goart "github.com/plar/go-adaptive-radix-tree"
 	"github.com/sharch/scache/data"
-	"sort"
 	"sync"
 )
 
@@ -60,84 +59,120 @@ func (art *AdaptiveRadixTree) Size() int {
 	return size
 }
 
+// Iterator 逐批遍历索引，每读取一批数据时短暂持有读锁，遍历过程中可以看到并发的写入
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	return &liveIterator{newCursorIterator(func(start []byte, inclusive bool, limit int) []*Item {
+		art.lock.RLock()
+		defer art.lock.RUnlock()
+		if reverse {
+			return artDescend(art.tree, start, inclusive, limit)
+		}
+		return artAscend(art.tree, start, inclusive, limit)
+	})}
 }
 
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-// Art 索引迭代器
-type artIterator struct {
-	currIndex int     // 当前遍历的下标位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key+位置索引信息
-}
-
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
-	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
+// 按照从小到大的顺序读取大于（或等于）start 的最多 limit 条数据
+// 基数树不支持从指定的 key 开始遍历，大于 start 的 key 依次是以 start 为前缀的 key，
+// 以及从后往前把 start 的某一个字节替换为更大的字节得到的前缀下的 key
+func artAscend(tree goart.Tree, start []byte, inclusive bool, limit int) []*Item {
+	values := make([]*Item, 0, limit)
+	saveValues := func(prefix []byte) goart.Callback {
+		return func(node goart.Node) bool {
+			if node.Kind() != goart.Leaf || !bytes.HasPrefix(node.Key(), prefix) {
+				return true
+			}
+			if cmp := bytes.Compare(node.Key(), start); start != nil && (cmp < 0 || cmp == 0 && !inclusive) {
+				return true
+			}
+			values = append(values, &Item{
+				key: node.Key(),
+				pos: node.Value().(*data.LogRecordPos),
+			})
+			return len(values) < limit
 		}
-		return true
 	}
 
-	tree.ForEach(saveValues)
-
-	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	if start == nil {
+		tree.ForEach(saveValues(nil))
+		return values
 	}
-}
-
-func (ai *artIterator) Rewind() {
-	ai.currIndex = 0
-}
-
-func (ai *artIterator) Seek(key []byte) {
-	if ai.reverse {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
+	tree.ForEachPrefix(start, saveValues(start))
+	for i := len(start) - 1; i >= 0 && len(values) < limit; i-- {
+		for b := int(start[i]) + 1; b <= 0xff && len(values) < limit; b++ {
+			prefix := append(start[:i:i], byte(b))
+			tree.ForEachPrefix(prefix, saveValues(prefix))
+		}
 	}
+	return values
 }
 
-func (ai *artIterator) Next() {
-	ai.currIndex += 1
-}
-
-func (ai *artIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
-}
+// 按照从大到小的顺序读取小于（或等于）start 的最多 limit 条数据，start 为空时从最大的 key 开始
+func artDescend(tree goart.Tree, start []byte, inclusive bool, limit int) []*Item {
+	values := make([]*Item, 0, limit)
+	saveValue := func(key []byte) {
+		if value, found := tree.Search(key); found {
+			values = append(values, &Item{key: key, pos: value.(*data.LogRecordPos)})
+		}
+	}
 
-func (ai *artIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
-}
+	// 倒序读取指定前缀下的 key，数据量超过剩余的数量时按照下一个字节拆分，避免读取整个前缀下的数据
+	var descendPrefix func(prefix []byte)
+	descendPrefix = func(prefix []byte) {
+		remain := limit - len(values)
+		var group []*Item
+		overflow := false
+		callback := func(node goart.Node) bool {
+			if node.Kind() != goart.Leaf || !bytes.HasPrefix(node.Key(), prefix) {
+				return true
+			}
+			if len(group) == remain {
+				overflow = true
+				return false
+			}
+			group = append(group, &Item{
+				key: node.Key(),
+				pos: node.Value().(*data.LogRecordPos),
+			})
+			return true
+		}
+		if len(prefix) == 0 {
+			tree.ForEach(callback)
+		} else {
+			tree.ForEachPrefix(prefix, callback)
+		}
 
-func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
-}
+		if !overflow {
+			for i := len(group) - 1; i >= 0; i-- {
+				values = append(values, group[i])
+			}
+			return
+		}
+		for b := 0xff; b >= 0 && len(values) < limit; b-- {
+			descendPrefix(append(prefix[:len(prefix):len(prefix)], byte(b)))
+		}
+		if len(prefix) > 0 && len(values) < limit {
+			saveValue(prefix)
+		}
+	}
 
-func (ai *artIterator) Close() {
-	ai.values = nil
+	if start == nil {
+		descendPrefix(nil)
+		return values
+	}
+	if inclusive {
+		saveValue(start)
+	}
+	for i := len(start) - 1; i >= 0 && len(values) < limit; i-- {
+		for b := int(start[i]) - 1; b >= 0 && len(values) < limit; b-- {
+			descendPrefix(append(start[:i:i], byte(b)))
+		}
+		if i > 0 && len(values) < limit {
+			saveValue(start[:i])
+		}
+	}
+	return values
 }
@@ -1,65 +1,167 @@
 package index
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/sharch/scache/data"
 	"go.etcd.io/bbolt"
+	"os"
 	"path/filepath"
+	"sync"
 )
 
-const bptreeIndexFileName = "bptree-index"
+// BPlusTreeIndexFileName B+ 树索引文件名称
+const BPlusTreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	metaKey         = []byte("meta")
+
+	errInvalidIndexMeta = errors.New("invalid index meta in bptree")
+)
+
+// IndexMeta 和索引在同一个事务中持久化的元信息
+type IndexMeta struct {
+	SeqNo    uint64 // 事务序列号
+	FileId   uint32 // 当前活跃文件 id
+	WriteOff int64  // 当前活跃文件写到的位置
+}
 
 // BPlusTree B+ 树索引
 // 主要封装了 go.etcd.io/bbolt 库
 type BPlusTree struct {
-	tree *bbolt.DB
+	tree   *bbolt.DB
+	meta   func() *IndexMeta // 获取需要和索引一起持久化的元信息
+	cipher *data.Cipher      // 加密 key 和位置信息，为空表示不加密
+	macKey []byte            // 计算 key 的 HMAC 使用的密钥
+
+	sortedLock  *sync.Mutex // 保护加密索引排序之后的缓存
+	sortedTxId  int         // 缓存对应的 bbolt 事务 id，之后有写入时缓存失效
+	sortedItems []*Item     // 加密索引解密并按照 key 排序之后的全部数据
 }
 
 // NewBPlusTree 初始化 B+ 树索引
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+	bpt, err := OpenBPlusTree(dirPath, syncWrites)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open bptree: %v", err))
+	}
+	return bpt
+}
+
+// OpenBPlusTree 打开 B+ 树索引，索引文件损坏时返回错误
+func OpenBPlusTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bbolt.Open(filepath.Join(dirPath, BPlusTreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, err
 	}
 
 	// 创建对应的 bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		_ = bptree.Close()
+		return nil, err
+	}
+
+	return &BPlusTree{tree: bptree, sortedLock: new(sync.Mutex)}, nil
+}
+
+// OpenBPlusTreeReadOnly 以只读方式打开 B+ 树索引，主要用于离线检查数据目录
+func OpenBPlusTreeReadOnly(dirPath string) (*BPlusTree, error) {
+	// bbolt 在文件不存在时会创建新的文件，只读模式下需要提前判断
+	fileName := filepath.Join(dirPath, BPlusTreeIndexFileName)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	opts := *bbolt.DefaultOptions
+	opts.ReadOnly = true
+	bptree, err := bbolt.Open(fileName, 0644, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := bptree.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(indexBucketName) == nil {
+			return errors.New("index bucket not found in bptree")
+		}
+		return nil
+	}); err != nil {
+		_ = bptree.Close()
+		return nil, err
 	}
+	return &BPlusTree{tree: bptree, sortedLock: new(sync.Mutex)}, nil
+}
 
-	return &BPlusTree{tree: bptree}
+// SetMetaProvider 设置获取元信息的方法，之后每次更新索引时都会在同一个事务中写入最新的元信息
+func (bpt *BPlusTree) SetMetaProvider(meta func() *IndexMeta) {
+	bpt.meta = meta
+}
+
+// Meta 读取持久化的元信息，不存在时返回 nil
+func (bpt *BPlusTree) Meta() (*IndexMeta, error) {
+	var meta *IndexMeta
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(metaKey)
+		if len(value) == 0 {
+			return nil
+		}
+		var err error
+		meta, err = decodeIndexMeta(value)
+		return err
+	})
+	return meta, err
+}
+
+// SaveMeta 单独持久化最新的元信息
+func (bpt *BPlusTree) SaveMeta() error {
+	return bpt.tree.Update(bpt.putMeta)
+}
+
+// 在更新索引的事务中写入最新的元信息
+func (bpt *BPlusTree) putMeta(tx *bbolt.Tx) error {
+	if bpt.meta == nil {
+		return nil
+	}
+	return tx.Bucket(metaBucketName).Put(metaKey, encodeIndexMeta(bpt.meta()))
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldVal []byte
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		oldVal = bucket.Get(key)
-		return bucket.Put(key, data.EncodeLogRecordPos(pos))
+		var err error
+		if oldPos, err = bpt.put(tx.Bucket(indexBucketName), key, pos); err != nil {
+			return err
+		}
+		return bpt.putMeta(tx)
 	}); err != nil {
 		panic("failed to put value in bptree")
 	}
-	if len(oldVal) == 0 {
-		return nil
-	}
-	return data.DecodeLogRecordPos(oldVal)
+	return oldPos
 }
 
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		value := bucket.Get(key)
-		if len(value) != 0 {
-			pos = data.DecodeLogRecordPos(value)
+		storeKey := bpt.storeKey(key)
+		value := tx.Bucket(indexBucketName).Get(storeKey)
+		if len(value) == 0 {
+			return nil
 		}
-		return nil
+		var err error
+		_, pos, err = bpt.decodeValue(storeKey, value)
+		return err
 	}); err != nil {
 		panic("failed to get value in bptree")
 	}
@@ -67,20 +169,71 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 }
 
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	var oldVal []byte
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(indexBucketName)
-		if oldVal = bucket.Get(key); len(oldVal) != 0 {
-			return bucket.Delete(key)
+		var err error
+		if oldPos, err = bpt.delete(tx.Bucket(indexBucketName), key); err != nil {
+			return err
 		}
-		return nil
+		return bpt.putMeta(tx)
 	}); err != nil {
 		panic("failed to delete value in bptree")
 	}
+	return oldPos, oldPos != nil
+}
+
+// ApplyBatch 在一个 bbolt 事务中执行所有的操作
+func (bpt *BPlusTree) ApplyBatch(ops []*BatchOp) []*data.LogRecordPos {
+	oldPositions := make([]*data.LogRecordPos, len(ops))
+	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		for i, op := range ops {
+			var err error
+			if op.Delete {
+				oldPositions[i], err = bpt.delete(bucket, op.Key)
+			} else {
+				oldPositions[i], err = bpt.put(bucket, op.Key, op.Pos)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return bpt.putMeta(tx)
+	}); err != nil {
+		panic("failed to apply batch in bptree")
+	}
+	return oldPositions
+}
+
+// 在事务中写入位置信息，返回之前的位置信息
+func (bpt *BPlusTree) put(bucket *bbolt.Bucket, key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	storeKey := bpt.storeKey(key)
+	var oldPos *data.LogRecordPos
+	if oldVal := bucket.Get(storeKey); len(oldVal) != 0 {
+		var err error
+		if _, oldPos, err = bpt.decodeValue(storeKey, oldVal); err != nil {
+			return nil, err
+		}
+	}
+	value, err := bpt.encodeValue(storeKey, key, pos)
+	if err != nil {
+		return nil, err
+	}
+	return oldPos, bucket.Put(storeKey, value)
+}
+
+// 在事务中删除位置信息，返回之前的位置信息
+func (bpt *BPlusTree) delete(bucket *bbolt.Bucket, key []byte) (*data.LogRecordPos, error) {
+	storeKey := bpt.storeKey(key)
+	oldVal := bucket.Get(storeKey)
 	if len(oldVal) == 0 {
-		return nil, false
+		return nil, nil
+	}
+	_, oldPos, err := bpt.decodeValue(storeKey, oldVal)
+	if err != nil {
+		return nil, err
 	}
-	return data.DecodeLogRecordPos(oldVal), true
+	return oldPos, bucket.Delete(storeKey)
 }
 
 func (bpt *BPlusTree) Size() int {
@@ -96,6 +249,9 @@ func (bpt *BPlusTree) Size() int {
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
+	if bpt.cipher != nil {
+		return bpt.newEncryptedIterator(reverse)
+	}
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
@@ -103,6 +259,32 @@ func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
+func encodeIndexMeta(meta *IndexMeta) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*3)
+	buf = binary.AppendUvarint(buf, meta.SeqNo)
+	buf = binary.AppendUvarint(buf, uint64(meta.FileId))
+	buf = binary.AppendVarint(buf, meta.WriteOff)
+	return buf
+}
+
+func decodeIndexMeta(buf []byte) (*IndexMeta, error) {
+	seqNo, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errInvalidIndexMeta
+	}
+	buf = buf[n:]
+	fileId, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errInvalidIndexMeta
+	}
+	buf = buf[n:]
+	writeOff, n := binary.Varint(buf)
+	if n <= 0 {
+		return nil, errInvalidIndexMeta
+	}
+	return &IndexMeta{SeqNo: seqNo, FileId: uint32(fileId), WriteOff: writeOff}, nil
+}
+
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
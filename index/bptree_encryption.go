@@ -0,0 +1,176 @@
+package index
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/sharch/scache/data"
+	"go.etcd.io/bbolt"
+	"sort"
+)
+
+var (
+	// 加密索引时使用的密钥 id，索引中所有 key 的 HMAC 都使用这个密钥计算
+	cipherKeyIdKey = []byte("cipher-key-id")
+
+	errInvalidIndexValue = errors.New("invalid encrypted value in bptree")
+
+	// ErrIndexCipherMismatch 索引的加密状态和当前的配置不一致，需要重建索引
+	ErrIndexCipherMismatch = errors.New("the bptree index encryption does not match the key provider")
+)
+
+// SetCipher 设置加密索引使用的 Cipher，需要在读写索引之前调用，cipher 为空表示不加密
+// 加密之后 bbolt 中的 key 是原始 key 的 HMAC，value 是加密之后的原始 key 和位置信息
+// 索引中已有的数据和 cipher 的加密状态不一致时返回 ErrIndexCipherMismatch
+// 只读打开的索引只能设置和已有数据一致的 cipher
+func (bpt *BPlusTree) SetCipher(cipher *data.Cipher) error {
+	update := bpt.tree.Update
+	if bpt.tree.IsReadOnly() {
+		update = bpt.tree.View
+	}
+	return update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		storedKeyId := meta.Get(cipherKeyIdKey)
+		empty, _ := tx.Bucket(indexBucketName).Cursor().First()
+		if cipher == nil {
+			if storedKeyId == nil {
+				return nil
+			}
+			if empty != nil {
+				return ErrIndexCipherMismatch
+			}
+			return meta.Delete(cipherKeyIdKey)
+		}
+
+		var keyId uint32
+		if storedKeyId == nil {
+			if empty != nil {
+				return ErrIndexCipherMismatch
+			}
+			id, err := cipher.CurrentKeyId()
+			if err != nil {
+				return err
+			}
+			keyId = id
+			if err := meta.Put(cipherKeyIdKey, binary.AppendUvarint(nil, uint64(keyId))); err != nil {
+				return err
+			}
+		} else {
+			id, n := binary.Uvarint(storedKeyId)
+			if n <= 0 {
+				return errInvalidIndexMeta
+			}
+			keyId = uint32(id)
+		}
+		macKey, err := cipher.DeriveKey(keyId, "bptree-index")
+		if err != nil {
+			return err
+		}
+		bpt.cipher = cipher
+		bpt.macKey = macKey
+		bpt.sortedLock.Lock()
+		bpt.sortedItems = nil
+		bpt.sortedLock.Unlock()
+		return nil
+	})
+}
+
+// 实际保存在 bbolt 中的 key，加密时使用 HMAC 代替原始的 key，相同的 key 总是对应相同的位置
+func (bpt *BPlusTree) storeKey(key []byte) []byte {
+	if bpt.cipher == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, bpt.macKey)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// 编码位置信息，加密时将原始的 key 一起加密保存，用于遍历
+func (bpt *BPlusTree) encodeValue(storeKey []byte, key []byte, pos *data.LogRecordPos) ([]byte, error) {
+	if bpt.cipher == nil {
+		return data.EncodeLogRecordPos(pos), nil
+	}
+	buf := binary.AppendUvarint(nil, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, data.EncodeLogRecordPos(pos)...)
+	return bpt.cipher.Encrypt(buf, storeKey)
+}
+
+// 解码位置信息，返回原始的 key 和位置信息
+func (bpt *BPlusTree) decodeValue(storeKey []byte, value []byte) ([]byte, *data.LogRecordPos, error) {
+	if bpt.cipher == nil {
+		return storeKey, data.DecodeLogRecordPos(value), nil
+	}
+	buf, err := bpt.cipher.Decrypt(value, storeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySize, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < keySize {
+		return nil, nil, errInvalidIndexValue
+	}
+	key := buf[n : n+int(keySize)]
+	return key, data.DecodeLogRecordPos(buf[n+int(keySize):]), nil
+}
+
+// 加密之后 bbolt 中 key 的顺序和原始 key 的顺序无关，需要解密全部数据之后重新排序
+// 创建迭代器的代价是 O(N) 的解密和 O(NlogN) 的排序，并且需要在内存中保存全部的 key
+// 排序的结果按照 bbolt 的事务 id 缓存，没有新的写入时再次创建迭代器直接复用
+func (bpt *BPlusTree) newEncryptedIterator(reverse bool) Iterator {
+	var values []*Item
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		bpt.sortedLock.Lock()
+		defer bpt.sortedLock.Unlock()
+		if bpt.sortedItems != nil && bpt.sortedTxId == tx.ID() {
+			values = bpt.sortedItems
+			return nil
+		}
+
+		if err := tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			key, pos, err := bpt.decodeValue(k, v)
+			if err != nil {
+				return err
+			}
+			values = append(values, &Item{key: key, pos: pos})
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.Slice(values, func(i, j int) bool {
+			return bytes.Compare(values[i].key, values[j].key) < 0
+		})
+		bpt.sortedItems = values
+		bpt.sortedTxId = tx.ID()
+		return nil
+	}); err != nil {
+		panic("failed to iterate encrypted bptree")
+	}
+
+	// 缓存的数据由多个迭代器共享，反向遍历时使用副本
+	if reverse {
+		reversed := make([]*Item, len(values))
+		for i, item := range values {
+			reversed[len(values)-1-i] = item
+		}
+		values = reversed
+	}
+	return &sortIterator{
+		reverse: reverse,
+		sorted:  true,
+		values:  values,
+	}
+}
+
+// Encrypted 索引是否已经加密
+func (bpt *BPlusTree) Encrypted() bool {
+	var encrypted bool
+	_ = bpt.tree.View(func(tx *bbolt.Tx) error {
+		if meta := tx.Bucket(metaBucketName); meta != nil {
+			encrypted = meta.Get(cipherKeyIdKey) != nil
+		}
+		return nil
+	})
+	return encrypted
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"github.com/sharch/scache/data"
-	"sort"
 	"sync"
 )
 
@@ -36,7 +35,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -55,84 +56,58 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+// Iterator 基于写时复制得到索引的副本，在副本上逐批遍历，不受之后写入的影响
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+	bt.lock.Lock()
+	tree := bt.tree.Clone()
+	bt.lock.Unlock()
+	return newCursorIterator(btreeFetch(tree, reverse))
 }
 
 func (bt *BTree) Close() error {
 	return nil
 }
 
-// BTree 索引迭代器
-type btreeIterator struct {
-	currIndex int     // 当前遍历的下标位置
-	reverse   bool    // 是否是反向遍历
-	values    []*Item // key+位置索引信息
-}
-
-func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	// 将所有的数据存放到数组中
-	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
-	}
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
-	}
-
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+// 基于写时复制得到当前索引的副本
+func (bt *BTree) clone() *BTree {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
 	}
 }
 
-func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
-}
-
-func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
+// 从 BTree 中按照顺序读取一批数据
+func btreeFetch(tree *btree.BTree, reverse bool) fetchFunc {
+	return func(start []byte, inclusive bool, limit int) []*Item {
+		values := make([]*Item, 0, limit)
+		saveValues := func(it btree.Item) bool {
+			item := it.(*Item)
+			if !inclusive && bytes.Equal(item.key, start) {
+				return true
+			}
+			values = append(values, item)
+			return len(values) < limit
+		}
+		switch {
+		case reverse && start == nil:
+			tree.Descend(saveValues)
+		case reverse:
+			tree.DescendLessOrEqual(&Item{key: start}, saveValues)
+		case start == nil:
+			tree.Ascend(saveValues)
+		default:
+			tree.AscendGreaterOrEqual(&Item{key: start}, saveValues)
+		}
+		return values
 	}
 }
-
-func (bti *btreeIterator) Next() {
-	bti.currIndex += 1
-}
-
-func (bti *btreeIterator) Valid() bool {
-	return bti.currIndex < len(bti.values)
-}
-
-func (bti *btreeIterator) Key() []byte {
-	return bti.values[bti.currIndex].key
-}
-
-func (bti *btreeIterator) Value() *data.LogRecordPos {
-	return bti.values[bti.currIndex].pos
-}
-
-func (bti *btreeIterator) Close() {
-	bti.values = nil
-}
@@ -0,0 +1,200 @@
+package index
+
+import (
+	"bytes"
+	"github.com/sharch/scache/data"
+	"sort"
+	"sync"
+)
+
+// 哈希索引的分片数量，不同分片的读写互不影响
+const hashShardCount = 64
+
+// HashIndex 分片哈希索引，不维护 key 的顺序，点查和写入的开销更小
+// 迭代器在第一次使用时才对 key 排序
+type HashIndex struct {
+	shards [hashShardCount]*hashShard
+}
+
+type hashShard struct {
+	items map[string]hashPos
+	lock  *sync.RWMutex
+}
+
+// 紧凑存储的位置信息，直接保存在 map 中，不需要为每个 key 单独分配 LogRecordPos
+type hashPos struct {
+	fid    uint32
+	size   uint32
+	offset int64
+	expire int64
+}
+
+// NewHashIndex 初始化哈希索引
+func NewHashIndex() *HashIndex {
+	hi := &HashIndex{}
+	for i := range hi.shards {
+		hi.shards[i] = &hashShard{
+			items: make(map[string]hashPos),
+			lock:  new(sync.RWMutex),
+		}
+	}
+	return hi
+}
+
+func (hi *HashIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	shard := hi.shard(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	shard.items[string(key)] = hashPos{
+		fid:    pos.Fid,
+		size:   pos.Size,
+		offset: pos.Offset,
+		expire: pos.Expire,
+	}
+	shard.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return oldPos.logRecordPos()
+}
+
+func (hi *HashIndex) Get(key []byte) *data.LogRecordPos {
+	shard := hi.shard(key)
+	shard.lock.RLock()
+	pos, ok := shard.items[string(key)]
+	shard.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return pos.logRecordPos()
+}
+
+func (hi *HashIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
+	shard := hi.shard(key)
+	shard.lock.Lock()
+	oldPos, ok := shard.items[string(key)]
+	if ok {
+		delete(shard.items, string(key))
+	}
+	shard.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return oldPos.logRecordPos(), true
+}
+
+func (hi *HashIndex) Size() int {
+	var size int
+	for _, shard := range hi.shards {
+		shard.lock.RLock()
+		size += len(shard.items)
+		shard.lock.RUnlock()
+	}
+	return size
+}
+
+func (hi *HashIndex) Iterator(reverse bool) Iterator {
+	// 依次复制每个分片中的数据，排序推迟到迭代器第一次使用的时候
+	var values []*Item
+	for _, shard := range hi.shards {
+		shard.lock.RLock()
+		for key, pos := range shard.items {
+			values = append(values, &Item{key: []byte(key), pos: pos.logRecordPos()})
+		}
+		shard.lock.RUnlock()
+	}
+	return &sortIterator{
+		reverse: reverse,
+		values:  values,
+	}
+}
+
+func (hi *HashIndex) Close() error {
+	return nil
+}
+
+func (hi *HashIndex) shard(key []byte) *hashShard {
+	return hi.shards[shardHash(key)%hashShardCount]
+}
+
+// 计算 key 的 FNV-1a 哈希值，用于选择分片
+func shardHash(key []byte) uint32 {
+	var h uint32 = 2166136261
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+func (p hashPos) logRecordPos() *data.LogRecordPos {
+	return &data.LogRecordPos{
+		Fid:    p.fid,
+		Offset: p.offset,
+		Size:   p.size,
+		Expire: p.expire,
+	}
+}
+
+// 在创建时复制全部数据的迭代器，第一次使用时才排序
+type sortIterator struct {
+	currIndex int     // 当前遍历的下标位置
+	reverse   bool    // 是否是反向遍历
+	sorted    bool    // 是否已经排序
+	values    []*Item // key+位置索引信息
+}
+
+// 第一次使用时按照遍历的方向对 key 排序
+func (hi *sortIterator) sort() {
+	if hi.sorted {
+		return
+	}
+	sort.Slice(hi.values, func(i, j int) bool {
+		cmp := bytes.Compare(hi.values[i].key, hi.values[j].key)
+		if hi.reverse {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	hi.sorted = true
+}
+
+func (hi *sortIterator) Rewind() {
+	hi.sort()
+	hi.currIndex = 0
+}
+
+func (hi *sortIterator) Seek(key []byte) {
+	hi.sort()
+	if hi.reverse {
+		hi.currIndex = sort.Search(len(hi.values), func(i int) bool {
+			return bytes.Compare(hi.values[i].key, key) <= 0
+		})
+	} else {
+		hi.currIndex = sort.Search(len(hi.values), func(i int) bool {
+			return bytes.Compare(hi.values[i].key, key) >= 0
+		})
+	}
+}
+
+func (hi *sortIterator) Next() {
+	hi.currIndex += 1
+}
+
+func (hi *sortIterator) Valid() bool {
+	return hi.currIndex < len(hi.values)
+}
+
+func (hi *sortIterator) Key() []byte {
+	hi.sort()
+	return hi.values[hi.currIndex].key
+}
+
+func (hi *sortIterator) Value() *data.LogRecordPos {
+	hi.sort()
+	return hi.values[hi.currIndex].pos
+}
+
+func (hi *sortIterator) Close() {
+	hi.values = nil
+}
@@ -27,6 +27,40 @@ type Indexer interface {
 	Close() error
 }
 
+// BatchOp 批量更新索引中的一个操作
+type BatchOp struct {
+	Key    []byte
+	Pos    *data.LogRecordPos // 写入的位置信息，删除操作不需要
+	Delete bool               // 是否是删除操作
+}
+
+// BatchIndexer 支持批量更新的索引，一个批次中的所有操作原子地生效
+type BatchIndexer interface {
+	Indexer
+
+	// ApplyBatch 按照顺序执行所有的操作，返回每个操作执行之前 key 对应的位置信息
+	ApplyBatch(ops []*BatchOp) []*data.LogRecordPos
+}
+
+// ApplyBatch 批量更新索引，索引不支持批量更新时依次执行每个操作
+func ApplyBatch(indexer Indexer, ops []*BatchOp) []*data.LogRecordPos {
+	if len(ops) == 0 {
+		return nil
+	}
+	if bi, ok := indexer.(BatchIndexer); ok {
+		return bi.ApplyBatch(ops)
+	}
+	oldPositions := make([]*data.LogRecordPos, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			oldPositions[i], _ = indexer.Delete(op.Key)
+		} else {
+			oldPositions[i] = indexer.Put(op.Key, op.Pos)
+		}
+	}
+	return oldPositions
+}
+
 type IndexType = int8
 
 const (
@@ -38,6 +72,12 @@ const (
 
 	// BPTree B+ 树索引
 	BPTree
+
+	// Hash 分片哈希索引
+	Hash
+
+	// ShardedBtree 分片 BTree 索引
+	ShardedBtree
 )
 
 // NewIndexer 根据类型初始化索引
@@ -49,11 +89,34 @@ func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
 		return NewART()
 	case BPTree:
 		return NewBPlusTree(dirPath, sync)
+	case Hash:
+		return NewHashIndex()
+	case ShardedBtree:
+		return NewShardedBTree()
 	default:
 		panic("unsupported index type")
 	}
 }
 
+// Clone 复制索引当前的内容，返回一个独立的内存索引，之后对原索引的修改不会影响到副本
+func Clone(indexer Indexer) Indexer {
+	// BTree 支持写时复制，不需要拷贝全部的数据
+	if bt, ok := indexer.(*BTree); ok {
+		return bt.clone()
+	}
+	if sbt, ok := indexer.(*ShardedBTree); ok {
+		return sbt.clone()
+	}
+
+	bt := NewBTree()
+	iterator := indexer.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		bt.Put(iterator.Key(), iterator.Value())
+	}
+	return bt
+}
+
 type Item struct {
 	key []byte
 	pos *data.LogRecordPos
@@ -86,3 +149,12 @@ type Iterator interface {
 	// Close 关闭迭代器，释放相应资源
 	Close()
 }
+
+// LiveIterator 遍历过程中可以看到并发写入的迭代器，每次从索引中读取一批数据
+// 位置信息指向读取这一批数据时的数据文件
+type LiveIterator interface {
+	Iterator
+
+	// OnFetch 设置读取每一批数据时的包装函数，wrap 必须调用 fetch 读取数据
+	OnFetch(wrap func(fetch func()))
+}
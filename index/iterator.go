@@ -0,0 +1,77 @@
+package index
+
+import "github.com/sharch/scache/data"
+
+// 游标迭代器每次从索引中读取的数据量
+const iteratorBatchSize = 256
+
+// 按照顺序从 start 开始读取最多 limit 条数据，inclusive 表示是否包含 start 本身，start 为空表示从头开始
+type fetchFunc func(start []byte, inclusive bool, limit int) []*Item
+
+// 游标迭代器，每次只从索引中读取一批数据，当前批次遍历完之后再从最后一个 key 继续读取
+// 不需要在创建时复制整个索引，占用的内存和索引大小无关
+type cursorIterator struct {
+	fetch     fetchFunc
+	wrap      func(fetch func()) // 不为空时通过 wrap 读取每一批数据
+	currIndex int                // 当前遍历的下标位置
+	values    []*Item            // 当前批次的 key+位置索引信息
+	last      bool               // 当前批次是否是最后一批
+}
+
+func newCursorIterator(fetch fetchFunc) *cursorIterator {
+	return &cursorIterator{fetch: fetch}
+}
+
+func (ci *cursorIterator) load(start []byte, inclusive bool) {
+	fetch := func() {
+		ci.values = ci.fetch(start, inclusive, iteratorBatchSize)
+	}
+	if ci.wrap != nil {
+		ci.wrap(fetch)
+	} else {
+		fetch()
+	}
+	ci.currIndex = 0
+	ci.last = len(ci.values) < iteratorBatchSize
+}
+
+func (ci *cursorIterator) Rewind() {
+	ci.load(nil, true)
+}
+
+func (ci *cursorIterator) Seek(key []byte) {
+	ci.load(key, true)
+}
+
+func (ci *cursorIterator) Next() {
+	ci.currIndex += 1
+	if ci.currIndex >= len(ci.values) && !ci.last {
+		ci.load(ci.values[len(ci.values)-1].key, false)
+	}
+}
+
+func (ci *cursorIterator) Valid() bool {
+	return ci.currIndex < len(ci.values)
+}
+
+func (ci *cursorIterator) Key() []byte {
+	return ci.values[ci.currIndex].key
+}
+
+func (ci *cursorIterator) Value() *data.LogRecordPos {
+	return ci.values[ci.currIndex].pos
+}
+
+func (ci *cursorIterator) Close() {
+	ci.values = nil
+	ci.last = true
+}
+
+// 直接在索引上遍历的游标迭代器，每一批数据读取的是当时索引中的位置信息
+type liveIterator struct {
+	*cursorIterator
+}
+
+func (li *liveIterator) OnFetch(wrap func(fetch func())) {
+	li.wrap = wrap
+}
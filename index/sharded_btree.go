@@ -0,0 +1,171 @@
+package index
+
+import (
+	"bytes"
+	"container/heap"
+	"github.com/sharch/scache/data"
+)
+
+// 分片 BTree 索引的分片数量
+const btreeShardCount = 16
+
+// ShardedBTree 分片 BTree 索引，key 按照哈希值分散到多个独立加锁的 BTree 中
+// 不同分片的写入互不阻塞，遍历时合并所有分片的迭代器得到全局有序的结果
+type ShardedBTree struct {
+	shards [btreeShardCount]*BTree
+}
+
+// NewShardedBTree 初始化分片 BTree 索引
+func NewShardedBTree() *ShardedBTree {
+	sbt := &ShardedBTree{}
+	for i := range sbt.shards {
+		sbt.shards[i] = NewBTree()
+	}
+	return sbt
+}
+
+func (sbt *ShardedBTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	return sbt.shard(key).Put(key, pos)
+}
+
+func (sbt *ShardedBTree) Get(key []byte) *data.LogRecordPos {
+	return sbt.shard(key).Get(key)
+}
+
+func (sbt *ShardedBTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+	return sbt.shard(key).Delete(key)
+}
+
+func (sbt *ShardedBTree) Size() int {
+	var size int
+	for _, shard := range sbt.shards {
+		size += shard.Size()
+	}
+	return size
+}
+
+func (sbt *ShardedBTree) Iterator(reverse bool) Iterator {
+	iters := make([]Iterator, len(sbt.shards))
+	for i, shard := range sbt.shards {
+		iters[i] = shard.Iterator(reverse)
+	}
+	return newMergeIterator(iters, reverse)
+}
+
+func (sbt *ShardedBTree) Close() error {
+	return nil
+}
+
+func (sbt *ShardedBTree) shard(key []byte) *BTree {
+	return sbt.shards[shardHash(key)%btreeShardCount]
+}
+
+// 基于写时复制得到当前索引的副本，每个分片单独复制
+func (sbt *ShardedBTree) clone() *ShardedBTree {
+	cloned := &ShardedBTree{}
+	for i, shard := range sbt.shards {
+		cloned.shards[i] = shard.clone()
+	}
+	return cloned
+}
+
+// 合并迭代器，将多个有序的迭代器合并为一个全局有序的迭代器
+// 各个迭代器中的 key 不能重复
+type mergeIterator struct {
+	iters []Iterator
+	h     *mergeHeap
+}
+
+func newMergeIterator(iters []Iterator, reverse bool) *mergeIterator {
+	return &mergeIterator{
+		iters: iters,
+		h:     &mergeHeap{reverse: reverse},
+	}
+}
+
+// 重新将所有有效的迭代器放入堆中
+func (mi *mergeIterator) init() {
+	mi.h.iters = mi.h.iters[:0]
+	for _, it := range mi.iters {
+		if it.Valid() {
+			mi.h.iters = append(mi.h.iters, it)
+		}
+	}
+	heap.Init(mi.h)
+}
+
+func (mi *mergeIterator) Rewind() {
+	for _, it := range mi.iters {
+		it.Rewind()
+	}
+	mi.init()
+}
+
+func (mi *mergeIterator) Seek(key []byte) {
+	for _, it := range mi.iters {
+		it.Seek(key)
+	}
+	mi.init()
+}
+
+func (mi *mergeIterator) Next() {
+	top := mi.h.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(mi.h, 0)
+	} else {
+		heap.Pop(mi.h)
+	}
+}
+
+func (mi *mergeIterator) Valid() bool {
+	return len(mi.h.iters) > 0
+}
+
+func (mi *mergeIterator) Key() []byte {
+	return mi.h.iters[0].Key()
+}
+
+func (mi *mergeIterator) Value() *data.LogRecordPos {
+	return mi.h.iters[0].Value()
+}
+
+func (mi *mergeIterator) Close() {
+	for _, it := range mi.iters {
+		it.Close()
+	}
+	mi.h.iters = nil
+}
+
+// 按照当前 key 排序的迭代器堆，堆顶是下一个要返回的 key
+type mergeHeap struct {
+	iters   []Iterator
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(Iterator))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.iters)
+	it := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return it
+}
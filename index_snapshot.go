@@ -0,0 +1,290 @@
+package scache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// 加载索引快照时每读取多少条记录批量更新一次索引
+const indexSnapshotBatchSize = 4096
+
+var errInvalidIndexSnapshot = errors.New("invalid index snapshot file")
+
+// 索引快照的元信息，保存在快照文件的第一条记录中
+type indexSnapshotMeta struct {
+	fileId    uint32           // 快照覆盖到的数据文件 id
+	offset    int64            // 快照覆盖到的数据文件位置
+	seqNo     uint64           // 事务序列号
+	keyNum    uint64           // 快照中的 key 数量
+	fileSizes map[uint32]int64 // 保存快照时每个数据文件的大小，用于检查数据文件是否被修改过
+	reclaims  map[uint32]int64 // 每个数据文件中无效的数据量
+}
+
+// 是否需要保存内存索引快照，B+ 树索引本身就保存在磁盘上
+func (db *DB) indexSnapshotEnabled() bool {
+	return db.options.IndexType != BPlusTree
+}
+
+// 保存内存索引快照，下次启动时只需要读取快照之后写入的数据
+// 遍历索引的同时通过缓冲区写入文件，不在内存中保存完整的快照内容
+// 先写临时文件再重命名，保证快照文件是完整的
+// 在访问此方法前必须持有互斥锁
+func (db *DB) saveIndexSnapshot() error {
+	meta := &indexSnapshotMeta{
+		fileId:    db.activeFile.FileId,
+		offset:    db.activeFile.WriteOff,
+		seqNo:     db.seqNo,
+		keyNum:    uint64(db.index.Size()),
+		fileSizes: make(map[uint32]int64),
+		reclaims:  db.fileReclaimSize,
+	}
+	for fid, file := range db.allDataFiles() {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		meta.fileSizes[fid] = size
+	}
+
+	tmpFileName := filepath.Join(db.options.DirPath, data.IndexSnapshotFileName+".tmp")
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(tmpFileName)
+	}()
+
+	writer := bufio.NewWriterSize(file, 64*1024)
+	metaRecord, _ := data.EncodeLogRecord(&data.LogRecord{Value: meta.encode()})
+	if _, err := writer.Write(metaRecord); err != nil {
+		return err
+	}
+	var keyNum uint64
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		encRecord, _, err := db.cipher.EncodeLogRecord(&data.LogRecord{
+			Key:   iterator.Key(),
+			Value: data.EncodeLogRecordPos(iterator.Value()),
+		}, data.ChecksumCRC32)
+		if err == nil {
+			_, err = writer.Write(encRecord)
+		}
+		if err != nil {
+			iterator.Close()
+			return err
+		}
+		keyNum++
+	}
+	iterator.Close()
+	if keyNum != meta.keyNum {
+		return errInvalidIndexSnapshot
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, filepath.Join(db.options.DirPath, data.IndexSnapshotFileName))
+}
+
+// 加载内存索引快照，返回快照覆盖到的数据文件 id 和位置
+// 读取快照的同时分批更新索引，快照中途校验失败时丢弃已经加载的索引
+// 快照不存在、校验失败或者数据文件已经被修改过时返回 false，需要从 hint 文件和数据文件中加载索引
+func (db *DB) loadIndexSnapshot() (uint32, int64, bool) {
+	snapshotFileName := filepath.Join(db.options.DirPath, data.IndexSnapshotFileName)
+	if _, err := os.Stat(snapshotFileName); err != nil {
+		return 0, 0, false
+	}
+
+	ops := make([]*index.BatchOp, 0, indexSnapshotBatchSize)
+	meta, err := db.readIndexSnapshot(func(key []byte, pos *data.LogRecordPos) {
+		// 已经过期的数据不再加载
+		if pos.IsExpired() {
+			db.addReclaimSize(pos)
+			return
+		}
+		ops = append(ops, &index.BatchOp{Key: key, Pos: pos})
+		if len(ops) == indexSnapshotBatchSize {
+			index.ApplyBatch(db.index, ops)
+			ops = ops[:0]
+		}
+	})
+	if err != nil {
+		log.Printf("ignore index snapshot: %v\n", err)
+		db.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, db.options.SyncWrites)
+		db.reclaimSize = 0
+		db.fileReclaimSize = make(map[uint32]int64)
+		return 0, 0, false
+	}
+	index.ApplyBatch(db.index, ops)
+
+	for fid, size := range meta.reclaims {
+		db.fileReclaimSize[fid] += size
+		db.reclaimSize += size
+	}
+	db.seqNo = meta.seqNo
+	return meta.fileId, meta.offset, true
+}
+
+// 读取并校验快照文件，依次将快照中的每一条索引交给 fn 处理
+func (db *DB) readIndexSnapshot(fn func(key []byte, pos *data.LogRecordPos)) (*indexSnapshotMeta, error) {
+	snapshotFile, err := data.OpenIndexSnapshotFile(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	snapshotFile.Cipher = db.cipher
+	defer func() {
+		_ = snapshotFile.Close()
+	}()
+
+	metaRecord, offset, err := snapshotFile.ReadLogRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := decodeIndexSnapshotMeta(metaRecord.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查数据文件是否和保存快照时一致，之后只允许在覆盖到的数据文件之后追加写入
+	allFiles := db.allDataFiles()
+	for fid, file := range allFiles {
+		if fid > meta.fileId {
+			continue
+		}
+		expected, ok := meta.fileSizes[fid]
+		if !ok {
+			return nil, errInvalidIndexSnapshot
+		}
+		size, err := file.IoManager.Size()
+		if err != nil {
+			return nil, err
+		}
+		if fid < meta.fileId && size != expected || fid == meta.fileId && size < meta.offset {
+			return nil, errInvalidIndexSnapshot
+		}
+	}
+	for fid := range meta.fileSizes {
+		if _, ok := allFiles[fid]; !ok {
+			return nil, errInvalidIndexSnapshot
+		}
+	}
+
+	var keyNum uint64
+	for {
+		logRecord, size, err := snapshotFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		fn(logRecord.Key, data.DecodeLogRecordPos(logRecord.Value))
+		keyNum++
+		offset += size
+	}
+	if keyNum != meta.keyNum {
+		return nil, errInvalidIndexSnapshot
+	}
+	return meta, nil
+}
+
+// 删除内存索引快照，数据文件被 merge 重写之后快照就失效了
+func removeIndexSnapshot(dirPath string) error {
+	err := os.Remove(filepath.Join(dirPath, data.IndexSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (meta *indexSnapshotMeta) encode() []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(4+len(meta.fileSizes)*3))
+	buf = binary.AppendUvarint(buf, uint64(meta.fileId))
+	buf = binary.AppendVarint(buf, meta.offset)
+	buf = binary.AppendUvarint(buf, meta.seqNo)
+	buf = binary.AppendUvarint(buf, meta.keyNum)
+	buf = binary.AppendUvarint(buf, uint64(len(meta.fileSizes)))
+	for fid, size := range meta.fileSizes {
+		buf = binary.AppendUvarint(buf, uint64(fid))
+		buf = binary.AppendVarint(buf, size)
+		buf = binary.AppendVarint(buf, meta.reclaims[fid])
+	}
+	return buf
+}
+
+func decodeIndexSnapshotMeta(buf []byte) (*indexSnapshotMeta, error) {
+	var readOff int
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf[readOff:])
+		if n <= 0 {
+			return 0, errInvalidIndexSnapshot
+		}
+		readOff += n
+		return v, nil
+	}
+	readVarint := func() (int64, error) {
+		v, n := binary.Varint(buf[readOff:])
+		if n <= 0 {
+			return 0, errInvalidIndexSnapshot
+		}
+		readOff += n
+		return v, nil
+	}
+
+	meta := &indexSnapshotMeta{
+		fileSizes: make(map[uint32]int64),
+		reclaims:  make(map[uint32]int64),
+	}
+	fileId, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	meta.fileId = uint32(fileId)
+	if meta.offset, err = readVarint(); err != nil {
+		return nil, err
+	}
+	if meta.seqNo, err = readUvarint(); err != nil {
+		return nil, err
+	}
+	if meta.keyNum, err = readUvarint(); err != nil {
+		return nil, err
+	}
+	fileNum, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < fileNum; i++ {
+		fid, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		size, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		reclaim, err := readVarint()
+		if err != nil {
+			return nil, err
+		}
+		meta.fileSizes[uint32(fid)] = size
+		if reclaim != 0 {
+			meta.reclaims[uint32(fid)] = reclaim
+		}
+	}
+	return meta, nil
+}
@@ -2,6 +2,7 @@ package scache
 
 import (
 	"bytes"
+	"github.com/sharch/scache/data"
 	"github.com/sharch/scache/index"
 )
 
@@ -9,17 +10,38 @@ import (
 type Iterator struct {
 	indexIter index.Iterator // 索引迭代器
 	db        *DB
+	files     map[uint32]*data.DataFile // 创建迭代器时引用的数据文件
+	fileGen   uint64                    // 引用的数据文件集合的版本
+	snapshot  *Snapshot                 // 不为空时从快照中读取数据
+	view      *snapshotView             // 快照的索引视图
+	txn       *Txn                      // 不为空时优先读取事务中暂存的数据
 	options   IteratorOptions
+	closed    bool
 }
 
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
+	it := &Iterator{
 		db:        db,
+		fileGen:   db.pinFiles(),
+		files:     db.allDataFiles(),
 		indexIter: indexIter,
 		options:   opts,
 	}
+	// 索引迭代器可以看到创建之后的写入，读取每一批位置信息的同时记录当时的数据文件
+	// 引用期间被替换的数据文件不会被关闭，这一批位置信息始终可以从记录的数据文件中读取
+	if liveIter, ok := indexIter.(index.LiveIterator); ok {
+		liveIter.OnFetch(func(fetch func()) {
+			db.mu.RLock()
+			defer db.mu.RUnlock()
+			fetch()
+			it.files = db.allDataFiles()
+		})
+	}
+	return it
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
@@ -53,25 +75,38 @@ func (it *Iterator) Key() []byte {
 // Value 当前遍历位置的 Value 数据
 func (it *Iterator) Value() ([]byte, error) {
 	logRecordPos := it.indexIter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	return it.db.getValueByPosition(logRecordPos)
+	if it.txn != nil {
+		if value, ok := it.txn.getPending(it.indexIter.Key()); ok {
+			return value, nil
+		}
+	}
+	if it.snapshot != nil {
+		return it.snapshot.readValue(it.view.dataFileOf(logRecordPos), logRecordPos)
+	}
+	return it.db.readValueFromDataFile(it.files[logRecordPos.Fid], logRecordPos)
 }
 
 // Close 关闭迭代器，释放相应资源
 func (it *Iterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
 	it.indexIter.Close()
+	if it.files != nil {
+		it.db.unpinFiles(it.fileGen)
+	}
 }
 
+// 跳过前缀不匹配以及已经过期的 key
 func (it *Iterator) skipToNext() {
 	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
-	}
-
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		if it.indexIter.Value().IsExpired() {
+			continue
+		}
 		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
+		if prefixLen == 0 || prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
 			break
 		}
 	}
@@ -1,7 +1,9 @@
 package scache
 
 import (
+	"context"
 	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
 	"github.com/sharch/scache/utils"
 	"io"
 	"os"
@@ -17,20 +19,42 @@ const (
 )
 
 // Merge 清理无效数据，生成 Hint 文件
+// merge 完成之后直接替换当前实例的旧数据文件，读写操作不需要停止，也不需要重启数据库
+// MergeMode 为 MergeSelective 时只重写无效数据比例达到 FileMergeRatio 的旧数据文件
 func (db *DB) Merge() error {
+	return db.MergeWithOptions(context.Background(), DefaultMergeOptions)
+}
+
+// MergeWithOptions 按照配置项进行 merge，读写数据文件时按照 BytesPerSecond 限流
+// context 被取消时停止 merge 并清理 merge 目录，已经安装到当前实例中的结果不会回滚
+func (db *DB) MergeWithOptions(ctx context.Context, opts MergeOptions) error {
+	if opts.BytesPerSecond < 0 {
+		return ErrInvalidMergeRate
+	}
+	db.reclaimExpiredKeys()
+	if db.options.MergeMode == MergeSelective {
+		return db.mergeSelectedFiles(ctx, opts)
+	}
+
+	db.mu.Lock()
 	// 如果数据库为空，则直接返回
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 	// 如果 merge 正在进行当中，则直接返回
 	if db.isMerging {
 		db.mu.Unlock()
 		return ErrMergeIsProgress
 	}
+	// 上一次 merge 的文件没有安装完成，merge 目录需要保留到下次打开
+	if db.mergeInstallFailed {
+		db.mu.Unlock()
+		return ErrMergeNotInstalled
+	}
 
 	// 查看可以 merge 的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dataFilesSize()
 	if err != nil {
 		db.mu.Unlock()
 		return err
@@ -41,41 +65,38 @@ func (db *DB) Merge() error {
 	}
 
 	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
+	availableDiskSize, err := utils.AvailableDiskSize(db.options.DirPath)
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
+	if uint64(totalSize-db.reclaimSize)+db.options.DiskReserveSize >= availableDiskSize {
 		db.mu.Unlock()
 		return ErrNoEnoughSpaceForMerge
 	}
 
 	db.isMerging = true
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
 	}()
 
-	// 持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
+	// 持久化当前活跃文件，将其转换为旧的数据文件，并打开新的活跃文件
+	if err := db.rotateActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	// 将当前活跃文件转换为旧的数据文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	// 打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return nil
-	}
 	// 记录最近没有参与 merge 的文件 id
 	nonMergeFileId := db.activeFile.FileId
 
-	// 取出所有需要 merge 的文件
+	// 取出所有需要 merge 的文件，merge 期间引用这些文件，避免文件句柄被替换或者关闭
 	var mergeFiles []*data.DataFile
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
+	fileGen := db.pinFiles()
+	defer db.unpinFiles(fileGen)
 	db.mu.Unlock()
 
 	//	待 merge 的文件从小到大进行排序，依次 merge
@@ -83,6 +104,60 @@ func (db *DB) Merge() error {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 
+	// 重写有效的数据，并将 merge 的结果安装到当前实例中
+	tracker := newMergeTracker(ctx, opts, len(mergeFiles))
+	if err := db.writeMergeFiles(tracker, mergeFiles, nonMergeFileId); err != nil {
+		_ = os.RemoveAll(db.getMergePath())
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		_ = os.RemoveAll(db.getMergePath())
+		return err
+	}
+	return db.installMergeFiles()
+}
+
+// 从内存索引中删除已经过期的 key，并将对应的数据计入可以回收的数据量，使过期的数据也能触发 merge
+// 先在不持有锁的情况下遍历索引，再逐个删除仍然指向同一位置的 key
+// 遍历期间引用数据文件，避免 RebuildIndex 关闭正在遍历的 B+ 树索引
+func (db *DB) reclaimExpiredKeys() {
+	type expiredKey struct {
+		key []byte
+		pos *data.LogRecordPos
+	}
+	db.mu.RLock()
+	idx := db.index
+	fileGen := db.pinFiles()
+	db.mu.RUnlock()
+
+	var expiredKeys []*expiredKey
+	iterator := idx.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if pos := iterator.Value(); pos.IsExpired() {
+			expiredKeys = append(expiredKeys, &expiredKey{key: iterator.Key(), pos: pos})
+		}
+	}
+	iterator.Close()
+	db.unpinFiles(fileGen)
+	if len(expiredKeys) == 0 {
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, expired := range expiredKeys {
+		pos := db.index.Get(expired.key)
+		if pos == nil || pos.Fid != expired.pos.Fid || pos.Offset != expired.pos.Offset {
+			continue
+		}
+		if _, ok := db.index.Delete(expired.key); ok {
+			db.addReclaimSize(pos)
+		}
+	}
+}
+
+// 将待 merge 的文件中有效的数据重写到 merge 目录中，并生成 hint 文件和标识 merge 完成的文件
+func (db *DB) writeMergeFiles(tracker *mergeTracker, mergeFiles []*data.DataFile, nonMergeFileId uint32) error {
 	mergePath := db.getMergePath()
 	// 如果目录存在，说明发生过 merge，将其删除掉
 	if _, err := os.Stat(mergePath); err == nil {
@@ -95,43 +170,64 @@ func (db *DB) Merge() error {
 		return err
 	}
 	// 打开一个新的临时 bitcask 实例
+	// 临时实例只用来写数据文件，不需要维护索引
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.IndexType = BTree
+	mergeOptions.AutoMergeInterval = 0
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
 
 	// 打开 hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(mergePath, db.options.Checksum)
 	if err != nil {
 		return err
 	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
 	// 遍历处理每个数据文件
 	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
+		offset := dataFile.HeaderSize()
 		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			logRecord, size, err := readLogRecord(dataFile, offset, db.verifyOnScan())
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
 				return err
 			}
+			if err := tracker.read(size); err != nil {
+				return err
+			}
 			// 解析拿到实际的 key
 			realKey, _ := parseLogRecordKey(logRecord.Key)
 			logRecordPos := db.index.Get(realKey)
-			// 和内存中的索引位置进行比较，如果有效则重写
+			// 和内存中的索引位置进行比较，如果有效且没有过期则重写
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
-				// 清除事务标记
+				logRecordPos.Offset == offset &&
+				!logRecord.IsExpired() {
+				// 清除事务标记，并使用当前的压缩方式重新压缩
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+				logRecord, err = db.recompressLogRecord(logRecord)
+				if err != nil {
+					return err
+				}
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
 					return err
 				}
+				if err := tracker.write(int64(pos.Size)); err != nil {
+					return err
+				}
 				// 将当前位置索引写到 Hint 文件当中
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
 					return err
@@ -140,6 +236,7 @@ func (db *DB) Merge() error {
 			// 增加 offset
 			offset += size
 		}
+		tracker.fileDone()
 	}
 
 	// sync 保证持久化
@@ -151,7 +248,12 @@ func (db *DB) Merge() error {
 	}
 
 	// 写标识 merge 完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	return writeMergeFinishedFile(mergePath, nonMergeFileId)
+}
+
+// 写标识 merge 完成的文件，记录最近没有参与 merge 的文件 id
+func writeMergeFinishedFile(dirPath string, nonMergeFileId uint32) error {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
 		return err
 	}
@@ -167,7 +269,57 @@ func (db *DB) Merge() error {
 		return err
 	}
 
-	return nil
+	return mergeFinishedFile.Close()
+}
+
+// merge 过程中的限流、取消和进度统计
+type mergeTracker struct {
+	ctx        context.Context
+	limiter    *utils.RateLimiter
+	progress   MergeProgress
+	onProgress func(progress MergeProgress)
+}
+
+func newMergeTracker(ctx context.Context, opts MergeOptions, filesTotal int) *mergeTracker {
+	tracker := &mergeTracker{
+		ctx:        ctx,
+		progress:   MergeProgress{FilesTotal: filesTotal},
+		onProgress: opts.OnProgress,
+	}
+	if opts.BytesPerSecond > 0 {
+		tracker.limiter = utils.NewRateLimiter(opts.BytesPerSecond)
+	}
+	return tracker
+}
+
+// 记录读取的字节数，并按照限流等待
+func (mt *mergeTracker) read(n int64) error {
+	mt.progress.BytesRead += n
+	return mt.wait(n)
+}
+
+// 记录重写的字节数，并按照限流等待
+func (mt *mergeTracker) write(n int64) error {
+	mt.progress.BytesCopied += n
+	return mt.wait(n)
+}
+
+func (mt *mergeTracker) wait(n int64) error {
+	if err := mt.ctx.Err(); err != nil {
+		return err
+	}
+	if mt.limiter == nil {
+		return nil
+	}
+	return mt.limiter.WaitN(mt.ctx, n)
+}
+
+// 一个数据文件处理完成，回调进度
+func (mt *mergeTracker) fileDone() {
+	mt.progress.FilesDone++
+	if mt.onProgress != nil {
+		mt.onProgress(mt.progress)
+	}
 }
 
 func (db *DB) getMergePath() string {
@@ -187,38 +339,46 @@ func (db *DB) loadMergeFiles() error {
 		_ = os.RemoveAll(mergePath)
 	}()
 
+	// 没有 merge 完成则直接返回
+	mergeFinFileName := filepath.Join(mergePath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
+		return nil
+	}
+	if err := db.moveMergeFiles(mergePath, nonMergeFileId); err != nil {
+		return err
+	}
+	// B+ 树索引中的位置还指向 merge 之前的数据文件
+	db.indexRebuildNeeded = true
+	return nil
+}
+
+// 删除已经参与 merge 的旧数据文件，并将 merge 目录中的文件移动到数据目录中
+func (db *DB) moveMergeFiles(mergePath string, nonMergeFileId uint32) error {
 	dirEntries, err := os.ReadDir(mergePath)
 	if err != nil {
 		return err
 	}
 
-	// 查找标识 merge 完成的文件，判断 merge 是否处理完了
-	var mergeFinished bool
 	var mergeFileNames []string
 	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
-		}
-		if entry.Name() == data.SeqNoFileName {
-			continue
-		}
-		if entry.Name() == fileLockName {
+		switch entry.Name() {
+		case data.SeqNoFileName, fileLockName, index.BPlusTreeIndexFileName, data.IndexSnapshotFileName:
 			continue
 		}
 		mergeFileNames = append(mergeFileNames, entry.Name())
 	}
 
-	// 没有 merge 完成则直接返回
-	if !mergeFinished {
-		return nil
-	}
-
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
-	if err != nil {
-		return nil
+	// 内存索引快照中的位置已经失效
+	if err := removeIndexSnapshot(db.options.DirPath); err != nil {
+		return err
 	}
 
-	// 删除旧的数据文件
+	// 删除旧的数据文件和对应的 hint 文件
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
 		fileName := data.GetDataFileName(db.options.DirPath, fileId)
@@ -227,6 +387,10 @@ func (db *DB) loadMergeFiles() error {
 				return err
 			}
 		}
+		hintFileName := data.GetHintFileName(db.options.DirPath, fileId)
+		if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
 	// 将新的数据文件移动到数据目录中
@@ -245,6 +409,9 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
 		return 0, err
@@ -258,20 +425,41 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 
 // 从 hint 文件中加载索引
 func (db *DB) loadIndexFromHintFile() error {
+	var ops []*index.BatchOp
+	if err := readHintFile(db.options.DirPath, db.cipher, func(key []byte, pos *data.LogRecordPos) {
+		// 已经过期的数据不再加载
+		if pos.IsExpired() {
+			db.addReclaimSize(pos)
+		} else {
+			ops = append(ops, &index.BatchOp{Key: key, Pos: pos})
+		}
+	}); err != nil {
+		return err
+	}
+	index.ApplyBatch(db.index, ops)
+	return nil
+}
+
+// 读取 hint 文件中的所有位置索引
+func readHintFile(dirPath string, cipher *data.Cipher, fn func(key []byte, pos *data.LogRecordPos)) error {
 	// 查看 hint 索引文件是否存在
-	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
+	hintFileName := filepath.Join(dirPath, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 
 	//	打开 hint 索引文件
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := data.OpenHintFile(dirPath, data.ChecksumCRC32)
 	if err != nil {
 		return err
 	}
+	hintFile.Cipher = cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
 
 	// 读取文件中的索引
-	var offset int64 = 0
+	offset := hintFile.HeaderSize()
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
@@ -282,9 +470,116 @@ func (db *DB) loadIndexFromHintFile() error {
 		}
 
 		// 解码拿到实际的位置索引
-		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		fn(logRecord.Key, data.DecodeLogRecordPos(logRecord.Value))
 		offset += size
 	}
 	return nil
 }
+
+// 将 merge 完成的数据文件和 hint 文件安装到当前实例中，不需要重启数据库
+// 只有替换数据文件和更新索引时需要持有互斥锁，快照和迭代器引用的旧数据文件在释放之后才会关闭
+func (db *DB) installMergeFiles() error {
+	mergePath := db.getMergePath()
+	mergeFinFileName := filepath.Join(mergePath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); os.IsNotExist(err) {
+		return nil
+	}
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// 读取 merge 之后的位置索引
+	mergedPositions := make(map[string]*data.LogRecordPos)
+	if err := readHintFile(mergePath, db.cipher, func(key []byte, pos *data.LogRecordPos) {
+		mergedPositions[string(key)] = pos
+	}); err != nil {
+		return err
+	}
+
+	// 预先打开 merge 之后的数据文件，文件被移动到数据目录之后句柄仍然有效
+	mergeFileIds, err := getDataFileIds(mergePath)
+	if err != nil {
+		return err
+	}
+	mergedFiles := make(map[uint32]*data.DataFile, len(mergeFileIds))
+	closeMergedFiles := func() {
+		for _, file := range mergedFiles {
+			_ = file.Close()
+		}
+	}
+	for _, fid := range mergeFileIds {
+		dataFile, err := data.OpenDataFile(mergePath, uint32(fid), db.options.OlderFileIOType, db.options.Checksum, 0)
+		if err != nil {
+			closeMergedFiles()
+			return err
+		}
+		dataFile.Cipher = db.cipher
+		mergedFiles[uint32(fid)] = dataFile
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			closeMergedFiles()
+			return err
+		}
+		dataFile.WriteOff = size
+	}
+
+	// 找出位于旧数据文件中的 key，merge 期间的写入只会进入新的数据文件
+	var candidates [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().Fid < nonMergeFileId {
+			candidates = append(candidates, iterator.Key())
+		}
+	}
+	iterator.Close()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 先移动 merge 之后的文件，成功之后再替换内存中的数据文件
+	// 移动失败时继续使用原来的数据文件，merge 完成标识仍然留在 merge 目录中，下次打开时重新移动
+	if err := db.moveMergeFiles(mergePath, nonMergeFileId); err != nil {
+		closeMergedFiles()
+		db.mergeInstallFailed = true
+		return err
+	}
+
+	// 替换旧的数据文件，仍然被快照或者迭代器引用的文件延迟关闭
+	for fid, file := range db.olderFiles {
+		if fid >= nonMergeFileId {
+			continue
+		}
+		db.reclaimSize -= db.fileReclaimSize[fid]
+		delete(db.fileReclaimSize, fid)
+		delete(db.olderFiles, fid)
+		db.retireFile(file)
+	}
+	for fid, file := range mergedFiles {
+		db.olderFiles[fid] = file
+	}
+	db.nextFileGen()
+	closeErr := db.releaseStaleFiles()
+
+	// 更新内存索引，再次检查 key 是否仍然位于旧数据文件中，merge 时被丢弃的过期数据从索引中删除
+	for _, key := range candidates {
+		pos := db.index.Get(key)
+		if pos == nil || pos.Fid >= nonMergeFileId {
+			continue
+		}
+		if mergedPos := mergedPositions[string(key)]; mergedPos != nil {
+			db.index.Put(key, mergedPos)
+			delete(mergedPositions, string(key))
+		} else {
+			db.index.Delete(key)
+		}
+	}
+	// merge 期间被重新写入或者删除的 key，重写到新数据文件中的数据已经无效
+	for _, pos := range mergedPositions {
+		db.addReclaimSize(pos)
+	}
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	return closeErr
+}
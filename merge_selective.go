@@ -0,0 +1,336 @@
+package scache
+
+import (
+	"context"
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/fio"
+	"github.com/sharch/scache/utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 选择性 merge，只重写无效数据比例达到阈值的旧数据文件
+// 重写之后的文件保持原来的文件 id，逐个替换，不影响其他数据文件
+func (db *DB) mergeSelectedFiles(ctx context.Context, opts MergeOptions) error {
+	db.mu.Lock()
+	// 如果数据库为空，则直接返回
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	// 如果 merge 正在进行当中，则直接返回
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeIsProgress
+	}
+	// 上一次 merge 的文件没有安装完成，merge 目录需要保留到下次打开
+	if db.mergeInstallFailed {
+		db.mu.Unlock()
+		return ErrMergeNotInstalled
+	}
+
+	// 找出无效数据比例达到阈值的旧数据文件
+	var mergeFiles []*data.DataFile
+	var liveSize int64
+	for fid, file := range db.olderFiles {
+		size, err := file.IoManager.Size()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if size <= file.HeaderSize() {
+			continue
+		}
+		if float32(db.fileReclaimSize[fid])/float32(size) >= db.options.FileMergeRatio {
+			mergeFiles = append(mergeFiles, file)
+			liveSize += size - db.fileReclaimSize[fid]
+		}
+	}
+	if len(mergeFiles) == 0 {
+		db.mu.Unlock()
+		return ErrMergeRatioUnreached
+	}
+
+	// 查看剩余的空间容量是否可以容纳重写之后的数据量
+	availableDiskSize, err := utils.AvailableDiskSize(db.options.DirPath)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	if uint64(liveSize)+db.options.DiskReserveSize >= availableDiskSize {
+		db.mu.Unlock()
+		return ErrNoEnoughSpaceForMerge
+	}
+
+	db.isMerging = true
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+	// 重写期间引用数据文件，避免文件句柄被替换或者关闭
+	fileGen := db.pinFiles()
+	defer db.unpinFiles(fileGen)
+	db.mu.Unlock()
+
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+
+	mergePath := db.getMergePath()
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(mergePath)
+	}()
+
+	// 被重写的文件如果已经由 hint 文件索引，hint 文件中的位置会失效
+	// 先删除 hint 文件和标识 merge 完成的文件，保证重写期间重启时会从数据文件中重新加载索引
+	var nonMergeFileId uint32
+	var hintInvalidated bool
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); err == nil {
+		nonMergeFileId, err = db.getNonMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		if mergeFiles[0].FileId < nonMergeFileId {
+			if err := os.Remove(mergeFinFileName); err != nil {
+				return err
+			}
+			if err := os.Remove(filepath.Join(db.options.DirPath, data.HintFileName)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			hintInvalidated = true
+		}
+	}
+
+	// 已经替换完成的文件不需要回滚，取消时仍然需要重新生成 hint 文件
+	tracker := newMergeTracker(ctx, opts, len(mergeFiles))
+	var mergeErr error
+	for _, dataFile := range mergeFiles {
+		if mergeErr = db.compactDataFile(tracker, mergePath, dataFile); mergeErr != nil {
+			break
+		}
+		tracker.fileDone()
+	}
+
+	if hintInvalidated {
+		if err := db.rewriteHintFile(mergePath, nonMergeFileId); err != nil {
+			return err
+		}
+	}
+	return mergeErr
+}
+
+// 重写单个数据文件，只保留有效的数据
+// 事务完成的标记会全部保留，删除的标记只有在 key 不存在时才保留，避免重启时旧数据被重新加载
+// 过期的数据如果仍然是 key 最新的数据，替换为删除的标记
+func (db *DB) compactDataFile(tracker *mergeTracker, mergePath string, dataFile *data.DataFile) error {
+	fileId := dataFile.FileId
+	compactFile, err := data.OpenDataFile(mergePath, fileId, fio.StandardFIO, db.options.Checksum, 0)
+	if err != nil {
+		return err
+	}
+	compactFile.Cipher = db.cipher
+
+	type movedRecord struct {
+		key       []byte
+		oldOffset int64
+		pos       *data.LogRecordPos
+	}
+	var movedRecords []*movedRecord
+	// 被替换为删除标记的过期数据原来的位置
+	var expiredRecords []*movedRecord
+	var hintBuf []byte
+	// 重写之后文件中仍然无效的数据量
+	var reclaimSize int64
+
+	offset := dataFile.HeaderSize()
+	for {
+		logRecord, size, err := readLogRecord(dataFile, offset, db.verifyOnScan())
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			_ = compactFile.Close()
+			return err
+		}
+		if err := tracker.read(size); err != nil {
+			_ = compactFile.Close()
+			return err
+		}
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+
+		var keep, live bool
+		switch logRecord.Type {
+		case data.LogRecordTxnFinished:
+			keep = true
+		case data.LogRecordDeleted:
+			keep = db.index.Get(realKey) == nil
+		default:
+			pos := db.index.Get(realKey)
+			latest := pos != nil && pos.Fid == fileId && pos.Offset == offset
+			if !logRecord.IsExpired() {
+				live = latest
+				keep = live
+				break
+			}
+			// 过期的 key 可能已经从内存索引中删除
+			if keep = latest || pos == nil; keep {
+				if latest {
+					expiredRecords = append(expiredRecords, &movedRecord{key: realKey, oldOffset: offset})
+				}
+				logRecord = &data.LogRecord{
+					Key:  logRecordKeyWithSeq(realKey, nonTransactionSeqNo),
+					Type: data.LogRecordDeleted,
+				}
+			}
+		}
+
+		if keep {
+			// 使用当前的压缩方式和最新的密钥重写
+			if logRecord, err = db.recompressLogRecord(logRecord); err != nil {
+				_ = compactFile.Close()
+				return err
+			}
+			encRecord, encSize, err := db.cipher.EncodeLogRecord(logRecord, compactFile.Checksum())
+			if err != nil {
+				_ = compactFile.Close()
+				return err
+			}
+			newOffset := compactFile.WriteOff
+			if err := compactFile.Write(encRecord); err != nil {
+				_ = compactFile.Close()
+				return err
+			}
+			if err := tracker.write(encSize); err != nil {
+				_ = compactFile.Close()
+				return err
+			}
+			newPos := &data.LogRecordPos{Fid: fileId, Offset: newOffset, Size: uint32(encSize), Expire: logRecord.Expire}
+			hintRecord, err := data.EncodeHintRecord(db.cipher, db.options.Checksum, logRecord.Key, logRecord.Type, newPos)
+			if err != nil {
+				_ = compactFile.Close()
+				return err
+			}
+			hintBuf = append(hintBuf, hintRecord...)
+			if live {
+				movedRecords = append(movedRecords, &movedRecord{
+					key:       realKey,
+					oldOffset: offset,
+					pos:       newPos,
+				})
+			} else if logRecord.Type == data.LogRecordDeleted {
+				reclaimSize += encSize
+			}
+		}
+		offset += size
+	}
+	if err := compactFile.Sync(); err != nil {
+		_ = compactFile.Close()
+		return err
+	}
+	// 和其他旧的数据文件一样使用 OlderFileIOType 读取，文件被移动到数据目录之后句柄仍然有效
+	if db.options.OlderFileIOType != StandardIO {
+		if err := compactFile.SetIOManager(mergePath, db.options.OlderFileIOType); err != nil {
+			_ = compactFile.Close()
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 替换数据文件，文件被移动到数据目录之后句柄仍然有效
+	// 原来的 hint 文件和内存索引快照已经失效，先删除，替换之后再重新生成 hint 文件
+	if err := removeIndexSnapshot(db.options.DirPath); err != nil {
+		_ = compactFile.Close()
+		return err
+	}
+	hintFileName := data.GetHintFileName(db.options.DirPath, fileId)
+	if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		_ = compactFile.Close()
+		return err
+	}
+	srcPath := data.GetDataFileName(mergePath, fileId)
+	destPath := data.GetDataFileName(db.options.DirPath, fileId)
+	if err := os.Rename(srcPath, destPath); err != nil {
+		_ = compactFile.Close()
+		return err
+	}
+	if db.dataHintEnabled() {
+		if err := writeDataHintFile(db.options.DirPath, fileId, db.options.Checksum, hintBuf, compactFile.WriteOff); err != nil {
+			log.Printf("failed to write hint file for data file %d: %v\n", fileId, err)
+			_ = os.Remove(hintFileName)
+		}
+	}
+	db.olderFiles[fileId] = compactFile
+	db.retireFile(dataFile)
+	db.nextFileGen()
+	closeErr := db.releaseStaleFiles()
+
+	// 更新内存索引，重写期间被重新写入或者删除的 key 不再更新
+	for _, record := range movedRecords {
+		pos := db.index.Get(record.key)
+		if pos != nil && pos.Fid == fileId && pos.Offset == record.oldOffset {
+			db.index.Put(record.key, record.pos)
+		} else {
+			reclaimSize += int64(record.pos.Size)
+		}
+	}
+	for _, record := range expiredRecords {
+		pos := db.index.Get(record.key)
+		if pos != nil && pos.Fid == fileId && pos.Offset == record.oldOffset {
+			db.index.Delete(record.key)
+		}
+	}
+	db.reclaimSize += reclaimSize - db.fileReclaimSize[fileId]
+	db.fileReclaimSize[fileId] = reclaimSize
+	return closeErr
+}
+
+// 根据内存索引重新生成 hint 文件，只记录位于 nonMergeFileId 之前的数据文件中的位置
+func (db *DB) rewriteHintFile(mergePath string, nonMergeFileId uint32) error {
+	hintFile, err := data.OpenHintFile(mergePath, db.options.Checksum)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		pos := iterator.Value()
+		if pos.Fid >= nonMergeFileId {
+			continue
+		}
+		if err := hintFile.WriteHintRecord(iterator.Key(), pos); err != nil {
+			iterator.Close()
+			return err
+		}
+	}
+	iterator.Close()
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+
+	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
+	if err := os.Rename(filepath.Join(mergePath, data.HintFileName), hintFileName); err != nil {
+		return err
+	}
+	if err := writeMergeFinishedFile(mergePath, nonMergeFileId); err != nil {
+		return err
+	}
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	return os.Rename(filepath.Join(mergePath, data.MergeFinishedFileName), mergeFinFileName)
+}
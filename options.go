@@ -1,5 +1,12 @@
 package scache
 
+import (
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/fio"
+	"runtime"
+	"time"
+)
+
 type Options struct {
 	// 数据库数据目录
 	DirPath string
@@ -19,8 +26,56 @@ type Options struct {
 	// 启动时是否使用 MMap 加载数据
 	MMapAtStartup bool
 
+	// 活跃文件使用的 IO 类型，使用 MMapIO 时文件会预先扩展到 DataFileSize，关闭时截断到实际写入的大小
+	// 预先扩展时会实际分配 DataFileSize 大小的磁盘空间（Linux 使用 fallocate，其他类 Unix 系统逐个块写入，Windows 上 NTFS 扩展文件时分配），
+	// 每次打开新的活跃文件都会一次性占用这部分空间，DiskReserveSize 需要把它计算在内
+	ActiveFileIOType FileIOType
+
+	// 旧数据文件使用的 IO 类型
+	OlderFileIOType FileIOType
+
+	// value 的压缩方式，每条数据单独记录压缩方式，修改之后旧的数据仍然可以读取
+	Compression CompressionType
+
+	// 小于该长度的 value 不压缩
+	CompressionThreshold int
+
+	// 新建的数据文件和 hint 文件使用的校验算法，记录在文件头中，修改之后已有的文件仍然使用原来的算法
+	Checksum ChecksumType
+
+	// 读取数据时是否校验 crc，关闭 Get 时的校验可以降低读取的延迟
+	VerifyChecksums VerifyChecksumsPolicy
+
+	// 加密数据使用的密钥提供者，为空表示不加密
+	// 数据文件、hint 文件、索引快照和 B+ 树索引中的 key 和 value 都会加密，merge 时使用最新的密钥重新加密
+	KeyProvider KeyProvider
+
+	// 磁盘预留空间的大小，剩余空间低于该值时拒绝写入，数据库切换为只读模式，剩余空间恢复之后重新允许写入，为 0 表示不检查
+	DiskReserveSize uint64
+
 	//	数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	// merge 的方式，默认重写所有的旧数据文件
+	MergeMode MergeMode
+
+	// 选择性 merge 时单个数据文件的无效数据比例阈值，达到阈值的文件才会被重写
+	FileMergeRatio float32
+
+	// 启动时并发读取旧数据文件加载索引的协程数量，小于等于 1 时顺序读取
+	IndexLoadWorkers int
+
+	// 启动时是否严格校验数据文件
+	// 默认会截断最新数据文件末尾写入不完整的记录，开启后遇到损坏的记录直接返回错误
+	StrictRecovery bool
+
+	// 后台自动 merge 的检查间隔，为 0 表示不开启自动 merge
+	AutoMergeInterval time.Duration
+
+	// 允许自动 merge 的时间窗口，表示距离当天零点的时长，例如 2 * time.Hour 表示凌晨两点
+	// 开始和结束相等表示不限制时间，开始大于结束表示窗口跨过零点
+	AutoMergeWindowStart time.Duration
+	AutoMergeWindowEnd   time.Duration
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -40,6 +95,30 @@ type WriteBatchOptions struct {
 	SyncWrites bool
 }
 
+// MergeOptions merge 配置项
+type MergeOptions struct {
+	// 每秒允许读写的字节数，为 0 表示不限制
+	BytesPerSecond int64
+
+	// 进度回调，每处理完一个数据文件调用一次
+	OnProgress func(progress MergeProgress)
+}
+
+// VerifyOptions 离线检查和修复数据目录的配置项
+type VerifyOptions struct {
+	// 加密数据目录使用的密钥提供者，为空时无法检查加密的记录
+	// 修复时恢复出来的数据使用同一个密钥提供者重新加密
+	KeyProvider KeyProvider
+}
+
+// MergeProgress merge 的进度
+type MergeProgress struct {
+	FilesTotal  int   // 需要处理的数据文件数量
+	FilesDone   int   // 已经处理完成的数据文件数量
+	BytesRead   int64 // 已经读取的字节数
+	BytesCopied int64 // 已经重写的有效数据字节数
+}
+
 type IndexerType = int8
 
 const (
@@ -50,19 +129,100 @@ const (
 	ART
 
 	// BPlusTree B+ 树索引，将索引存储到磁盘上
+	// 开启加密之后创建迭代器需要解密全部的 key 并在内存中排序，没有新的写入时复用排序的结果
 	BPlusTree
+
+	// Hash 分片哈希索引，只适合点查的场景，遍历时需要先对 key 排序
+	Hash
+
+	// ShardedBTree 分片 BTree 索引，每个分片单独加锁，适合并发写入较多的场景
+	ShardedBTree
+)
+
+// CompressionType value 的压缩方式，自定义的压缩算法通过 data.RegisterCompressor 注册
+type CompressionType = data.CompressionType
+
+const (
+	// NoCompression 不压缩
+	NoCompression = data.NoCompression
+
+	// Deflate 使用标准库的 DEFLATE 算法压缩
+	Deflate = data.DeflateCompression
+)
+
+// FileIOType 数据文件的 IO 类型
+type FileIOType = fio.FileIOType
+
+const (
+	// StandardIO 标准文件 IO
+	StandardIO = fio.StandardFIO
+
+	// MMapIO 可读写的内存文件映射，读写都直接访问映射的内存
+	MMapIO = fio.MemoryMapRW
+)
+
+// ChecksumType 记录的校验算法
+type ChecksumType = data.ChecksumType
+
+const (
+	// CRC32 CRC32 IEEE 校验
+	CRC32 = data.ChecksumCRC32
+
+	// CRC32C CRC32 Castagnoli 校验，在支持的平台上有硬件加速
+	CRC32C = data.ChecksumCRC32C
+)
+
+type VerifyChecksumsPolicy = int8
+
+const (
+	// VerifyAlways 每次读取数据都校验
+	VerifyAlways VerifyChecksumsPolicy = iota
+
+	// VerifyOnStartupAndMerge 只在启动加载索引和 merge 时校验，Get、快照和迭代器读取数据时不校验
+	VerifyOnStartupAndMerge
+
+	// VerifyNever 不校验，启动时仍然会校验最新的数据文件，用于识别末尾写入不完整的记录
+	VerifyNever
+)
+
+// KeyProvider 提供加密使用的密钥
+type KeyProvider = data.KeyProvider
+
+// FileFormatVersion 数据文件和 hint 文件的格式版本
+const FileFormatVersion = data.FileFormatVersion
+
+type MergeMode = int8
+
+const (
+	// MergeAll 重写所有的旧数据文件，并生成 hint 文件
+	MergeAll MergeMode = iota
+
+	// MergeSelective 只重写无效数据比例达到阈值的旧数据文件，文件 id 保持不变
+	MergeSelective
 )
 
 const DefaultDir = "D:/code/scache/temp"
 
 var DefaultOptions = Options{
-	DirPath:            DefaultDir,
-	DataFileSize:       256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	BytesPerSync:       0,
-	IndexType:          BTree,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:              DefaultDir,
+	DataFileSize:         256 * 1024 * 1024, // 256MB
+	SyncWrites:           false,
+	BytesPerSync:         0,
+	IndexType:            BTree,
+	MMapAtStartup:        true,
+	ActiveFileIOType:     StandardIO,
+	OlderFileIOType:      StandardIO,
+	Compression:          NoCompression,
+	CompressionThreshold: 256,
+	Checksum:             CRC32C,
+	VerifyChecksums:      VerifyAlways,
+	DiskReserveSize:      64 * 1024 * 1024, // 64MB
+	DataFileMergeRatio:   0.5,
+	MergeMode:            MergeAll,
+	FileMergeRatio:       0.5,
+	IndexLoadWorkers:     runtime.NumCPU(),
+	StrictRecovery:       false,
+	AutoMergeInterval:    0,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -70,6 +230,15 @@ var DefaultIteratorOptions = IteratorOptions{
 	Reverse: false,
 }
 
+var DefaultMergeOptions = MergeOptions{
+	BytesPerSecond: 0,
+	OnProgress:     nil,
+}
+
+var DefaultVerifyOptions = VerifyOptions{
+	KeyProvider: nil,
+}
+
 var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
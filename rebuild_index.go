@@ -0,0 +1,120 @@
+package scache
+
+import (
+	"github.com/sharch/scache/index"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 打开索引，B+ 树索引文件不存在或者已经损坏时创建新的索引文件，加载数据文件之后再从数据文件中重建
+func (db *DB) openIndex() error {
+	if db.options.IndexType != BPlusTree {
+		db.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, db.options.SyncWrites)
+		return nil
+	}
+
+	indexFileName := filepath.Join(db.options.DirPath, index.BPlusTreeIndexFileName)
+	if _, err := os.Stat(indexFileName); os.IsNotExist(err) {
+		db.indexRebuildNeeded = true
+	}
+	bpt, err := index.OpenBPlusTree(db.options.DirPath, db.options.SyncWrites)
+	if err == nil {
+		// 索引的加密状态和当前配置不一致时无法使用，需要重建
+		if err = bpt.SetCipher(db.cipher); err != nil {
+			_ = bpt.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("bptree index can not be used: %v\n", err)
+		if bpt, err = db.recreateBPlusTree(); err != nil {
+			return err
+		}
+		db.indexRebuildNeeded = true
+	}
+	db.index = bpt
+	return nil
+}
+
+// 删除 B+ 树索引文件并创建新的空索引
+func (db *DB) recreateBPlusTree() (*index.BPlusTree, error) {
+	indexFileName := filepath.Join(db.options.DirPath, index.BPlusTreeIndexFileName)
+	if err := os.Remove(indexFileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	bpt, err := index.OpenBPlusTree(db.options.DirPath, db.options.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+	if err := bpt.SetCipher(db.cipher); err != nil {
+		_ = bpt.Close()
+		return nil, err
+	}
+	return bpt, nil
+}
+
+// RebuildIndex 丢弃当前的索引，从 hint 文件和数据文件中重新构建索引
+// B+ 树索引会重新创建索引文件，存在未释放的快照或者迭代器时不能重建
+// 内存索引重建之后，已经创建的迭代器继续遍历旧的索引
+func (db *DB) RebuildIndex() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.isMerging {
+		return ErrMergeIsProgress
+	}
+	if db.options.IndexType == BPlusTree && db.filesPinned() {
+		return ErrIndexInUse
+	}
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.rebuildIndex()
+}
+
+// 从 hint 文件和数据文件中重建索引
+// 在访问此方法前必须持有互斥锁
+func (db *DB) rebuildIndex() error {
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	if db.options.IndexType == BPlusTree {
+		bpt, err := db.recreateBPlusTree()
+		if err != nil {
+			return err
+		}
+		db.index = bpt
+	} else {
+		db.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, db.options.SyncWrites)
+	}
+
+	// 重新统计无效的数据量
+	db.reclaimSize = 0
+	db.fileReclaimSize = make(map[uint32]int64)
+
+	var fileIds []int
+	for fid := range db.allDataFiles() {
+		fileIds = append(fileIds, int(fid))
+	}
+	sort.Ints(fileIds)
+	db.fileIds = fileIds
+
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromDataFiles(0, 0); err != nil {
+		return err
+	}
+
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		bpt.SetMetaProvider(db.indexMeta)
+		if err := bpt.SaveMeta(); err != nil {
+			return err
+		}
+		db.seqNoFileExists = true
+	}
+	db.indexRebuildNeeded = false
+	log.Printf("rebuilt index from %d data files\n", len(fileIds))
+	return nil
+}
@@ -0,0 +1,225 @@
+package scache
+
+import (
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
+	"sync"
+)
+
+// Snapshot 数据库某一时刻的只读视图，固定在创建时的事务序列号上
+// 创建快照不需要复制索引，快照存在期间每次修改 key 都会记录修改之前的位置信息，读取时根据序列号还原
+// 快照释放之前，merge 不会关闭快照引用的旧数据文件
+type Snapshot struct {
+	db       *DB
+	mu       *sync.RWMutex
+	seqNo    uint64 // 创建快照时的序列号
+	fileGen  uint64 // 创建快照时引用的数据文件集合的版本
+	released bool   // 快照是否已经释放
+}
+
+// key 被修改之前的位置信息
+type keyVersion struct {
+	seqNo uint64             // 修改时的序列号
+	pos   *data.LogRecordPos // 修改之前的位置信息，为空表示 key 不存在
+	file  *data.DataFile     // 位置信息对应的数据文件
+}
+
+// 快照上的索引视图，位置信息需要从对应的数据文件中读取
+type snapshotView struct {
+	index     index.Indexer
+	files     map[uint32]*data.DataFile             // 构造视图时的数据文件
+	overrides map[*data.LogRecordPos]*data.DataFile // 从修改记录中还原的位置信息对应的数据文件
+}
+
+// Snapshot 创建一个当前时刻的只读快照，使用完毕后需要调用 Release 释放
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.newSnapshot()
+}
+
+// 创建快照
+// 在访问此方法前必须持有互斥锁
+func (db *DB) newSnapshot() *Snapshot {
+	snap := &Snapshot{
+		db:    db,
+		mu:    new(sync.RWMutex),
+		seqNo: db.seqNo,
+	}
+	snap.fileGen = db.pinFiles()
+	db.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// SeqNo 快照对应的序列号
+func (s *Snapshot) SeqNo() uint64 {
+	return s.seqNo
+}
+
+// Get 根据 key 读取快照中的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	s.db.mu.RLock()
+	logRecordPos, dataFile := s.db.positionAt(key, s.seqNo)
+	s.db.mu.RUnlock()
+	if logRecordPos == nil || logRecordPos.IsExpired() {
+		return nil, ErrKeyNotFound
+	}
+	return s.db.readValueFromDataFile(dataFile, logRecordPos)
+}
+
+// NewIterator 初始化快照上的迭代器
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	view := s.db.newSnapshotView(s.seqNo)
+	return &Iterator{
+		db:        s.db,
+		snapshot:  s,
+		view:      view,
+		indexIter: view.index.Iterator(opts.Reverse),
+		options:   opts,
+	}
+}
+
+// Fold 遍历快照中所有的数据，并执行用户指定的操作，函数返回 false 时终止遍历
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	iterator := s.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，释放后快照不能再被使用
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return
+	}
+	s.released = true
+	s.mu.Unlock()
+
+	s.db.mu.Lock()
+	delete(s.db.snapshots, s)
+	s.db.pruneKeyVersions()
+	s.db.mu.Unlock()
+	s.db.unpinFiles(s.fileGen)
+}
+
+// 从快照对应的数据文件中获取 value
+func (s *Snapshot) readValue(dataFile *data.DataFile, logRecordPos *data.LogRecordPos) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.readValueFromDataFile(dataFile, logRecordPos)
+}
+
+// 获取 key 在 seqNo 时刻的位置信息和对应的数据文件，key 不存在时返回 nil
+// 在访问此方法前必须持有读锁或者互斥锁
+func (db *DB) positionAt(key []byte, seqNo uint64) (*data.LogRecordPos, *data.DataFile) {
+	// seqNo 之后第一次修改之前的位置信息就是 seqNo 时刻的位置信息
+	for _, version := range db.keyVersions[string(key)] {
+		if version.seqNo > seqNo {
+			return version.pos, version.file
+		}
+	}
+	pos := db.index.Get(key)
+	if pos == nil {
+		return nil, nil
+	}
+	return pos, db.dataFileOf(pos)
+}
+
+// 构造 seqNo 时刻的索引视图，在当前的索引上还原 seqNo 之后被修改的 key
+// BTree 索引支持写时复制，不需要拷贝全部的数据，其他类型的索引需要持有读锁复制整个索引
+func (db *DB) newSnapshotView(seqNo uint64) *snapshotView {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	view := &snapshotView{
+		index:     index.Clone(db.index),
+		files:     db.allDataFiles(),
+		overrides: make(map[*data.LogRecordPos]*data.DataFile),
+	}
+	for key, versions := range db.keyVersions {
+		for _, version := range versions {
+			if version.seqNo <= seqNo {
+				continue
+			}
+			if version.pos == nil {
+				view.index.Delete([]byte(key))
+			} else {
+				view.index.Put([]byte(key), version.pos)
+				view.overrides[version.pos] = version.file
+			}
+			break
+		}
+	}
+	return view
+}
+
+// 位置信息对应的数据文件
+func (v *snapshotView) dataFileOf(pos *data.LogRecordPos) *data.DataFile {
+	if dataFile, ok := v.overrides[pos]; ok {
+		return dataFile
+	}
+	return v.files[pos.Fid]
+}
+
+// 记录 key 被修改之前的位置信息，只有存在快照时才需要记录
+// 在访问此方法前必须持有互斥锁
+func (db *DB) markKeyModified(key []byte, seqNo uint64, oldPos *data.LogRecordPos) {
+	if len(db.snapshots) == 0 {
+		return
+	}
+	version := &keyVersion{seqNo: seqNo, pos: oldPos}
+	if oldPos != nil {
+		version.file = db.dataFileOf(oldPos)
+	}
+	db.keyVersions[string(key)] = append(db.keyVersions[string(key)], version)
+}
+
+// 清理所有未释放的快照都不再需要的修改记录
+// 在访问此方法前必须持有互斥锁
+func (db *DB) pruneKeyVersions() {
+	if len(db.snapshots) == 0 {
+		db.keyVersions = make(map[string][]*keyVersion)
+		return
+	}
+	var minSeqNo uint64
+	var first = true
+	for snap := range db.snapshots {
+		if first || snap.seqNo < minSeqNo {
+			minSeqNo = snap.seqNo
+			first = false
+		}
+	}
+	for key, versions := range db.keyVersions {
+		i := 0
+		for i < len(versions) && versions[i].seqNo <= minSeqNo {
+			i++
+		}
+		if i == len(versions) {
+			delete(db.keyVersions, key)
+		} else if i > 0 {
+			db.keyVersions[key] = versions[i:]
+		}
+	}
+}
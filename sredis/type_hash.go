@@ -23,7 +23,10 @@ func (rds *RedisDataStructure) HSet(key, field, value []byte) (bool, error) {
 		exist = false
 	}
 
-	wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 	// 不存在则更新元数据
 	if !exist {
 		meta.size++
@@ -77,7 +80,10 @@ func (rds *RedisDataStructure) HDel(key, field []byte) (bool, error) {
 	}
 
 	if exist {
-		wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+		wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+		if err != nil {
+			return false, err
+		}
 		meta.size--
 		_ = wb.Put(key, meta.encode())
 		_ = wb.Delete(encKey)
@@ -37,7 +37,10 @@ func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint
 	}
 
 	// 更新元数据和数据部分
-	wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	if err != nil {
+		return 0, err
+	}
 	meta.size++
 	if isLeft {
 		meta.head--
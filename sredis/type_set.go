@@ -19,7 +19,10 @@ func (rds *RedisDataStructure) SAdd(key, member []byte) (bool, error) {
 	var ok bool
 	if _, err = rds.db.Get(sk.encode()); err == scache.ErrKeyNotFound {
 		// 不存在的话则更新
-		wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+		wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+		if err != nil {
+			return false, err
+		}
 		meta.size++
 		_ = wb.Put(key, meta.encode())
 		_ = wb.Put(sk.encode(), nil)
@@ -79,7 +82,10 @@ func (rds *RedisDataStructure) SRem(key, member []byte) (bool, error) {
 	}
 
 	// 更新
-	wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 	meta.size--
 	_ = wb.Put(key, meta.encode())
 	_ = wb.Delete(sk.encode())
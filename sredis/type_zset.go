@@ -36,7 +36,10 @@ func (rds *RedisDataStructure) ZAdd(key []byte, score float64, member []byte) (b
 	}
 
 	// 更新元数据和数据
-	wb := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	wb, err := rds.db.NewWriteBatch(scache.DefaultWriteBatchOptions)
+	if err != nil {
+		return false, err
+	}
 	if !exist {
 		meta.size++
 		_ = wb.Put(key, meta.encode())
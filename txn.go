@@ -0,0 +1,197 @@
+package scache
+
+import (
+	"github.com/sharch/scache/data"
+	"sync"
+)
+
+// Txn 乐观并发控制的读写事务
+// 事务内的读取基于开始时的快照，并且能读到自身未提交的写入
+// 提交时如果读取过的 key 在事务开始之后被修改过，则提交失败
+type Txn struct {
+	options       WriteBatchOptions
+	mu            *sync.Mutex
+	db            *DB
+	snapshot      *Snapshot                  // 事务开始时的快照
+	startSeqNo    uint64                     // 事务开始时的序列号
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	readSet       map[string]struct{}        // 事务读取过的 key
+	closed        bool                       // 事务是否已经提交或者回滚
+}
+
+// Begin 开启一个读写事务
+func (db *DB) Begin() (*Txn, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
+		return nil, ErrSeqNoFileNotExists
+	}
+
+	snap := db.newSnapshot()
+	txn := &Txn{
+		options:       DefaultWriteBatchOptions,
+		mu:            new(sync.Mutex),
+		db:            db,
+		snapshot:      snap,
+		startSeqNo:    snap.seqNo,
+		pendingWrites: make(map[string]*data.LogRecord),
+		readSet:       make(map[string]struct{}),
+	}
+	return txn, nil
+}
+
+// Get 读取数据，优先读取事务自身未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return nil, ErrTxnClosed
+	}
+
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDeleted || record.IsExpired() {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	// 记录读取过的 key，即使 key 不存在，提交时也需要检查
+	txn.readSet[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value}
+	return nil
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+
+	// 快照中不存在的数据，只需要丢弃暂存的写入
+	// 同时记录为读取过的 key，事务开始之后其他写入新增了这个 key 时提交失败，避免删除被静默忽略
+	txn.db.mu.RLock()
+	logRecordPos, _ := txn.db.positionAt(key, txn.startSeqNo)
+	txn.db.mu.RUnlock()
+	if logRecordPos == nil {
+		delete(txn.pendingWrites, string(key))
+		txn.readSet[string(key)] = struct{}{}
+		return nil
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+// NewIterator 初始化事务中的迭代器，遍历结果包含事务自身未提交的写入
+func (txn *Txn) NewIterator(opts IteratorOptions) *Iterator {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	// 在快照的索引视图上叠加暂存的写入
+	view := txn.db.newSnapshotView(txn.startSeqNo)
+	for _, record := range txn.pendingWrites {
+		if record.Type == data.LogRecordDeleted {
+			view.index.Delete(record.Key)
+		} else {
+			view.index.Put(record.Key, &data.LogRecordPos{Expire: record.Expire})
+		}
+	}
+
+	return &Iterator{
+		db:        txn.db,
+		snapshot:  txn.snapshot,
+		txn:       txn,
+		view:      view,
+		indexIter: view.index.Iterator(opts.Reverse),
+		options:   opts,
+	}
+}
+
+// Commit 提交事务，如果读取过的 key 在事务开始之后被修改过，则返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	defer txn.close()
+
+	if uint(len(txn.pendingWrites)) > txn.options.MaxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	// 加锁保证事务提交串行化
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	// 冲突检测
+	for key := range txn.readSet {
+		versions := txn.db.keyVersions[key]
+		if len(versions) > 0 && versions[len(versions)-1].seqNo > txn.startSeqNo {
+			return ErrTxnConflict
+		}
+	}
+
+	// 只读事务不需要写入数据
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	return txn.db.commitRecords(txn.pendingWrites, txn.options.SyncWrites)
+}
+
+// Rollback 回滚事务，丢弃所有暂存的写入
+func (txn *Txn) Rollback() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	txn.close()
+	return nil
+}
+
+// 结束事务，释放快照
+// 在访问此方法前必须持有事务的互斥锁
+func (txn *Txn) close() {
+	txn.closed = true
+	txn.pendingWrites = nil
+	txn.readSet = nil
+	txn.snapshot.Release()
+}
+
+// 读取事务中暂存的数据，第二个返回值表示是否存在暂存的数据
+func (txn *Txn) getPending(key []byte) ([]byte, bool) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return nil, false
+	}
+	record, ok := txn.pendingWrites[string(key)]
+	if !ok {
+		txn.readSet[string(key)] = struct{}{}
+		return nil, false
+	}
+	return record.Value, true
+}
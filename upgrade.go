@@ -0,0 +1,285 @@
+package scache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/fio"
+	"github.com/sharch/scache/index"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 升级文件时写入的临时文件后缀，写完之后再替换原来的文件
+const upgradeFileSuffix = ".upgrade"
+
+// Upgrade 将没有文件头的旧版本数据目录升级为当前的文件格式，数据目录不能被其他进程使用
+// 旧版本的记录没有过期时间，需要按照旧的格式解码之后使用当前的格式重新编码，记录的位置随之改变
+// merge 生成的 hint 文件按照新的位置重写，seq-no 和 merge 完成标识文件中的记录也重新编码
+// 内存索引快照和 B+ 树索引中的位置已经失效，直接删除，下次打开数据库时重新生成
+// 升级中断之后可以重新执行，已经升级的文件会被跳过
+func Upgrade(dirPath string) error {
+	fileLock, err := lockDir(dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	// 先安装已经完成的 merge，merge 目录中的文件也是旧的格式
+	db := &DB{options: Options{DirPath: dirPath}}
+	mergePath := db.getMergePath()
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err == nil {
+		if err := upgradeMetaFile(mergePath, data.MergeFinishedFileName); err != nil {
+			return err
+		}
+	}
+	if err := db.loadMergeFiles(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, upgradeFileSuffix),
+			strings.HasSuffix(name, data.HintFileNameSuffix),
+			name == data.IndexSnapshotFileName,
+			name == index.BPlusTreeIndexFileName:
+			if err := os.Remove(filepath.Join(dirPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range []string{data.SeqNoFileName, data.MergeFinishedFileName} {
+		if _, err := os.Stat(filepath.Join(dirPath, name)); err == nil {
+			if err := upgradeMetaFile(dirPath, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	fileIds, err := getDataFileIds(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fileIds {
+		if err := upgradeDataFile(dirPath, uint32(fid)); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(data.GetDataFileName(dirPath, uint32(fid))), err)
+		}
+	}
+
+	// 数据文件全部升级之后再重写 hint 文件，中断之后重新执行时也能计算出记录原来的位置
+	if _, err := os.Stat(filepath.Join(dirPath, data.HintFileName)); err == nil {
+		if err := upgradeMergeHintFile(dirPath); err != nil {
+			return fmt.Errorf("%s: %w", data.HintFileName, err)
+		}
+	}
+	return nil
+}
+
+// 读取文件开头的文件头，判断文件是否是没有文件头的旧格式
+func isLegacyFile(file *os.File) (bool, error) {
+	buf := make([]byte, data.FileHeaderSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	// 空文件在打开时会写入文件头
+	if n == 0 {
+		return false, nil
+	}
+	if _, err := data.DecodeFileHeader(buf[:n]); err != nil {
+		if errors.Is(err, data.ErrLegacyFileFormat) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// 将旧格式的数据文件中的记录逐条使用当前的格式重新编码，先写入临时文件，再替换原来的文件
+func upgradeDataFile(dirPath string, fileId uint32) error {
+	fileName := data.GetDataFileName(dirPath, fileId)
+	return rewriteFile(fileName, func(file *os.File, w io.Writer) (bool, error) {
+		legacy, err := isLegacyFile(file)
+		if err != nil || !legacy {
+			return false, err
+		}
+		fileSize, err := fileSizeOf(file)
+		if err != nil {
+			return false, err
+		}
+
+		checksum := DefaultOptions.Checksum
+		header := data.EncodeFileHeader(data.NewFileHeader(data.DataFileType, fileId, checksum))
+		if _, err := w.Write(header); err != nil {
+			return false, err
+		}
+		var offset int64
+		for {
+			logRecord, size, err := data.ReadLegacyLogRecord(file, offset, fileSize)
+			if err == io.EOF {
+				return true, nil
+			}
+			// 进程崩溃可能导致最后一条记录没有写完整，之后不会再有其他的记录
+			if err == io.ErrUnexpectedEOF {
+				log.Printf("data file %d has a torn record at offset %d, drop %d bytes\n", fileId, offset, fileSize-offset)
+				return true, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("read record at offset %d: %w", offset, err)
+			}
+			encRecord, _ := data.EncodeLogRecordWithChecksum(logRecord, checksum)
+			if _, err := w.Write(encRecord); err != nil {
+				return false, err
+			}
+			offset += size
+		}
+	})
+}
+
+// 将旧格式的 merge hint 文件重写为当前的格式，其中的位置改为指向升级之后的数据文件中的记录
+func upgradeMergeHintFile(dirPath string) error {
+	fileName := filepath.Join(dirPath, data.HintFileName)
+	return rewriteFile(fileName, func(file *os.File, w io.Writer) (bool, error) {
+		legacy, err := isLegacyFile(file)
+		if err != nil || !legacy {
+			return false, err
+		}
+		fileSize, err := fileSizeOf(file)
+		if err != nil {
+			return false, err
+		}
+
+		checksum := DefaultOptions.Checksum
+		header := data.EncodeFileHeader(data.NewFileHeader(data.HintFileType, 0, checksum))
+		if _, err := w.Write(header); err != nil {
+			return false, err
+		}
+		// merge 按照文件 id 的顺序写 hint 记录，只缓存一个数据文件的位置映射
+		var positions map[int64]*data.LogRecordPos
+		var positionsFid uint32
+		var offset int64
+		for {
+			logRecord, size, err := data.ReadLegacyLogRecord(file, offset, fileSize)
+			if err == io.EOF {
+				return true, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("read record at offset %d: %w", offset, err)
+			}
+			oldPos := data.DecodeLogRecordPos(logRecord.Value)
+			if positions == nil || positionsFid != oldPos.Fid {
+				if positions, err = upgradedPositions(dirPath, oldPos.Fid); err != nil {
+					return false, err
+				}
+				positionsFid = oldPos.Fid
+			}
+			pos, ok := positions[oldPos.Offset]
+			if !ok {
+				return false, fmt.Errorf("no record at offset %d of data file %d", oldPos.Offset, oldPos.Fid)
+			}
+			hintRecord := &data.LogRecord{Key: logRecord.Key, Value: data.EncodeLogRecordPos(pos)}
+			encRecord, _ := data.EncodeLogRecordWithChecksum(hintRecord, checksum)
+			if _, err := w.Write(encRecord); err != nil {
+				return false, err
+			}
+			offset += size
+		}
+	})
+}
+
+// 读取升级之后的数据文件，按照旧格式的记录大小推算出每条记录升级之前的位置
+func upgradedPositions(dirPath string, fileId uint32) (map[int64]*data.LogRecordPos, error) {
+	dataFile, err := data.OpenDataFile(dirPath, fileId, fio.StandardFIO, DefaultOptions.Checksum, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+
+	positions := make(map[int64]*data.LogRecordPos)
+	var legacyOffset int64
+	offset := dataFile.HeaderSize()
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return positions, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		positions[legacyOffset] = &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
+		legacyOffset += data.LegacyLogRecordSize(logRecord)
+		offset += size
+	}
+}
+
+// 使用当前的格式重新编码 seq-no 和 merge 完成标识文件中的记录，这些文件没有文件头
+// 能够按照旧格式通过校验的记录才需要升级
+func upgradeMetaFile(dirPath string, name string) error {
+	return rewriteFile(filepath.Join(dirPath, name), func(file *os.File, w io.Writer) (bool, error) {
+		fileSize, err := fileSizeOf(file)
+		if err != nil {
+			return false, err
+		}
+		logRecord, _, err := data.ReadLegacyLogRecord(file, 0, fileSize)
+		if err != nil {
+			return false, nil
+		}
+		encRecord, _ := data.EncodeLogRecord(logRecord)
+		_, err = w.Write(encRecord)
+		return err == nil, err
+	})
+}
+
+// 将 rewrite 写出的内容写入临时文件，持久化之后替换原来的文件，rewrite 返回 false 表示文件不需要升级
+func rewriteFile(fileName string, rewrite func(file *os.File, w io.Writer) (bool, error)) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	tmpFileName := fileName + upgradeFileSuffix
+	tmpFile, err := os.Create(tmpFileName)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	writer := bufio.NewWriter(tmpFile)
+	upgraded, err := rewrite(file, writer)
+	// 替换之前先关闭原来的文件，Windows 上不能替换打开的文件
+	_ = file.Close()
+	if err == nil && upgraded {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !upgraded {
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func fileSizeOf(file *os.File) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,14 @@
+//go:build openbsd
+
+package utils
+
+import "golang.org/x/sys/unix"
+
+// AvailableDiskSize 获取目录所在文件系统的剩余可用空间大小
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.F_bavail) * uint64(stat.F_bsize), nil
+}
@@ -0,0 +1,14 @@
+//go:build netbsd || solaris
+
+package utils
+
+import "golang.org/x/sys/unix"
+
+// AvailableDiskSize 获取目录所在文件系统的剩余可用空间大小
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	var stat unix.Statvfs_t
+	if err := unix.Statvfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * stat.Frsize, nil
+}
@@ -0,0 +1,14 @@
+//go:build aix || darwin || dragonfly || freebsd || linux
+
+package utils
+
+import "golang.org/x/sys/unix"
+
+// AvailableDiskSize 获取目录所在文件系统的剩余可用空间大小
+func AvailableDiskSize(dirPath string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
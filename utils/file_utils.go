@@ -5,7 +5,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	// "syscall"
 )
 
 // DirSize 获取一个目录的大小
@@ -23,20 +22,6 @@ func DirSize(dirPath string) (int64, error) {
 	return size, err
 }
 
-// AvailableDiskSize 获取磁盘剩余可用空间大小
-func AvailableDiskSize() (uint64, error) {
-	//wd, err := syscall.Getwd()
-	//if err != nil {
-	//	return 0, err
-	//}
-	//var stat syscall.Statfs_t
-	//if err = syscall.Statfs(wd, &stat); err != nil {
-	//	return 0, err
-	//}
-	//return stat.Bavail * uint64(stat.Bsize), nil
-	return uint64(1 * 1024 * 1024 * 1024), nil
-}
-
 // CopyDir 拷贝数据目录
 func CopyDir(src, dest string, exclude []string) error {
 	// 目标目标不存在则创建
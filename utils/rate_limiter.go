@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter 令牌桶限流器，令牌以字节为单位
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // 每秒产生的令牌数量
+	burst  float64   // 桶的容量
+	tokens float64   // 当前桶中的令牌数量
+	last   time.Time // 上次更新令牌的时间
+}
+
+// NewRateLimiter 初始化限流器，桶的容量为一秒产生的令牌数量
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// WaitN 获取 n 个令牌，令牌不足时阻塞等待，context 被取消时返回错误
+// n 可以超过桶的容量，此时令牌数量会变为负数，后续的请求需要等待更长的时间
+func (r *RateLimiter) WaitN(ctx context.Context, n int64) error {
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,609 @@
+package scache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofrs/flock"
+	"github.com/sharch/scache/data"
+	"github.com/sharch/scache/index"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type VerifyProblemKind = byte
+
+const (
+	// ProblemInvalidCRC 记录的 crc 校验失败
+	ProblemInvalidCRC VerifyProblemKind = iota + 1
+
+	// ProblemTornRecord 记录没有写完整，超出了文件末尾
+	ProblemTornRecord
+
+	// ProblemUncommittedTxn 事务记录没有对应的事务完成标识
+	ProblemUncommittedTxn
+
+	// ProblemDanglingHint hint 文件中的索引指向了不存在或者不匹配的记录
+	ProblemDanglingHint
+
+	// ProblemPosOutOfRange 索引位置超出了数据文件的末尾
+	ProblemPosOutOfRange
+
+	// ProblemInvalidFile 文件无法读取或者内容无法解析
+	ProblemInvalidFile
+)
+
+// VerifyProblem 检查数据目录时发现的问题
+type VerifyProblem struct {
+	FileName string            // 出现问题的文件
+	Offset   int64             // 出现问题的位置
+	Kind     VerifyProblemKind // 问题类型
+	Message  string            // 问题描述
+}
+
+// VerifyFileReport 单个文件的检查结果
+type VerifyFileReport struct {
+	FileName  string // 文件名称
+	Size      int64  // 文件大小
+	Records   int    // 有效记录的数量
+	ValidSize int64  // 有效记录占用的字节数
+}
+
+// VerifyReport 数据目录的检查结果
+type VerifyReport struct {
+	DirPath  string              // 数据目录
+	Files    []*VerifyFileReport // 每个文件的检查结果
+	Problems []*VerifyProblem    // 发现的所有问题
+}
+
+// OK 是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) addProblem(fileName string, offset int64, kind VerifyProblemKind, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &VerifyProblem{
+		FileName: fileName,
+		Offset:   offset,
+		Kind:     kind,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// String 问题的文字描述
+func (p *VerifyProblem) String() string {
+	return fmt.Sprintf("%s@%d: %s", p.FileName, p.Offset, p.Message)
+}
+
+// Verify 离线检查数据目录的完整性，数据目录不能被其他进程使用
+// 检查所有的数据文件、hint 索引文件、merge 完成标识文件、事务序列号文件以及 B+ 树索引
+// 所有的文件都以只读的方式打开，检查过程不会修改数据目录
+// 加密的数据目录需要使用 VerifyWithOptions 指定密钥提供者
+func Verify(dirPath string) (*VerifyReport, error) {
+	return VerifyWithOptions(dirPath, DefaultVerifyOptions)
+}
+
+// VerifyWithOptions 按照配置项检查数据目录，记录通过 crc 校验之后再解密，解密失败同样作为问题报告
+func VerifyWithOptions(dirPath string, opts VerifyOptions) (*VerifyReport, error) {
+	fileLock, err := lockDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	report := &VerifyReport{DirPath: dirPath}
+	fileIds, err := getDataFileIds(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查所有的数据文件，记录文件头有效的数据文件的大小，用于后面检查索引位置
+	dataFiles := &verifyDataFiles{
+		dirPath: dirPath,
+		cipher:  newVerifyCipher(opts),
+		sizes:   make(map[uint32]int64),
+		files:   make(map[uint32]*data.DataFile),
+	}
+	defer dataFiles.close()
+	uncommitted := make(map[uint64]*VerifyProblem)
+	for _, fid := range fileIds {
+		if err := verifyDataFile(report, dataFiles, uint32(fid), uncommitted); err != nil {
+			return nil, err
+		}
+	}
+	for _, problem := range uncommitted {
+		report.Problems = append(report.Problems, problem)
+	}
+
+	for _, fid := range fileIds {
+		if err := verifyDataHintFile(report, dataFiles, uint32(fid)); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifyHintFile(report, dataFiles); err != nil {
+		return nil, err
+	}
+	verifyMetaFile(report, dirPath, data.MergeFinishedFileName, func(value []byte) error {
+		_, err := strconv.Atoi(string(value))
+		return err
+	})
+	verifyMetaFile(report, dirPath, data.SeqNoFileName, func(value []byte) error {
+		_, err := strconv.ParseUint(string(value), 10, 64)
+		return err
+	})
+	verifyBPlusTreeIndex(report, dirPath, dataFiles.cipher, dataFiles.sizes)
+	return report, nil
+}
+
+// Repair 将数据目录中所有有效的记录恢复到一个新的数据目录中
+// 遇到损坏的记录时会向后查找下一条有效的记录，未提交的事务数据会被丢弃
+func Repair(dirPath string, destDirPath string) (*VerifyReport, error) {
+	return RepairWithOptions(dirPath, destDirPath, DefaultVerifyOptions)
+}
+
+// RepairWithOptions 按照配置项修复数据目录，加密的数据目录需要指定密钥提供者
+func RepairWithOptions(dirPath string, destDirPath string, opts VerifyOptions) (*VerifyReport, error) {
+	if entries, err := os.ReadDir(destDirPath); err == nil && len(entries) > 0 {
+		return nil, errors.New("the repair dest directory is not empty")
+	}
+
+	report, err := VerifyWithOptions(dirPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fileLock, err := lockDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	destOpts := DefaultOptions
+	destOpts.DirPath = destDirPath
+	destOpts.IndexType = BTree
+	destOpts.MMapAtStartup = false
+	destOpts.KeyProvider = opts.KeyProvider
+	destDB, err := Open(destOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	fileIds, err := getDataFileIds(dirPath)
+	if err != nil {
+		_ = destDB.Close()
+		return nil, err
+	}
+
+	apply := func(record *data.LogRecord) error {
+		// 已经过期的数据和删除的数据一样处理，覆盖之前重放的旧值
+		if record.Type == data.LogRecordDeleted || record.IsExpired() {
+			return destDB.Delete(record.Key)
+		}
+		// 解压之后按照目标数据库的配置重新写入
+		value, err := record.DecodeValue()
+		if err != nil {
+			return err
+		}
+		return destDB.put(record.Key, value, record.Expire)
+	}
+
+	// 按照文件 id 从小到大重放所有有效的记录
+	cipher := newVerifyCipher(opts)
+	transactionRecords := make(map[uint64][]*data.LogRecord)
+	for _, fid := range fileIds {
+		err := salvageDataFile(dirPath, uint32(fid), cipher, func(logRecord *data.LogRecord) error {
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			logRecord.Key = realKey
+			if seqNo == nonTransactionSeqNo {
+				return apply(logRecord)
+			}
+			if logRecord.Type != data.LogRecordTxnFinished {
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], logRecord)
+				return nil
+			}
+			for _, record := range transactionRecords[seqNo] {
+				if err := apply(record); err != nil {
+					return err
+				}
+			}
+			delete(transactionRecords, seqNo)
+			return nil
+		})
+		if err != nil {
+			_ = destDB.Close()
+			return nil, err
+		}
+	}
+
+	if err := destDB.Sync(); err != nil {
+		_ = destDB.Close()
+		return nil, err
+	}
+	return report, destDB.Close()
+}
+
+// 获取数据目录的文件锁，保证检查期间没有其他进程使用
+func lockDir(dirPath string) (*flock.Flock, error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(dirPath, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+	return fileLock, nil
+}
+
+// 密钥提供者为空时不解密
+func newVerifyCipher(opts VerifyOptions) *data.Cipher {
+	if opts.KeyProvider == nil {
+		return nil
+	}
+	return data.NewCipher(opts.KeyProvider)
+}
+
+// 检查期间以只读的方式打开的数据文件
+type verifyDataFiles struct {
+	dirPath string
+	cipher  *data.Cipher              // 解密记录使用的 Cipher
+	sizes   map[uint32]int64          // 文件头有效的数据文件的大小
+	files   map[uint32]*data.DataFile // 检查 hint 文件时打开的数据文件
+}
+
+// 获取文件头有效的数据文件，第一次获取时打开文件
+func (vf *verifyDataFiles) get(fileId uint32) (*data.DataFile, error) {
+	if dataFile, ok := vf.files[fileId]; ok {
+		return dataFile, nil
+	}
+	dataFile, err := data.OpenFileReadOnly(data.GetDataFileName(vf.dirPath, fileId), fileId, data.DataFileType)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Cipher = vf.cipher
+	vf.files[fileId] = dataFile
+	return dataFile, nil
+}
+
+func (vf *verifyDataFiles) close() {
+	for _, dataFile := range vf.files {
+		_ = dataFile.Close()
+	}
+}
+
+// 文件头无效、是旧的格式或者没有写完整
+func isFileHeaderError(err error) bool {
+	return errors.Is(err, data.ErrLegacyFileFormat) ||
+		errors.Is(err, data.ErrUnsupportedFileVersion) ||
+		errors.Is(err, data.ErrInvalidFileHeader) ||
+		errors.Is(err, data.ErrIncompleteFileHeader) ||
+		errors.Is(err, data.ErrUnknownChecksum)
+}
+
+// 以只读的方式打开带有文件头的文件，文件头有问题时记录到检查结果中并返回 nil
+func openVerifyFile(report *VerifyReport, fileReport *VerifyFileReport, filePath string,
+	fileId uint32, typ data.FileType, cipher *data.Cipher) (*data.DataFile, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fileReport.Size = stat.Size()
+	report.Files = append(report.Files, fileReport)
+
+	dataFile, err := data.OpenFileReadOnly(filePath, fileId, typ)
+	if err != nil {
+		if !isFileHeaderError(err) {
+			return nil, err
+		}
+		report.addProblem(fileReport.FileName, 0, ProblemInvalidFile, "%v", err)
+		return nil, nil
+	}
+	dataFile.Cipher = cipher
+	return dataFile, nil
+}
+
+// 检查单个数据文件，遇到损坏的记录后停止检查这个文件
+func verifyDataFile(report *VerifyReport, dataFiles *verifyDataFiles, fileId uint32,
+	uncommitted map[uint64]*VerifyProblem) error {
+	filePath := data.GetDataFileName(dataFiles.dirPath, fileId)
+	fileReport := &VerifyFileReport{FileName: filepath.Base(filePath)}
+	dataFile, err := openVerifyFile(report, fileReport, filePath, fileId, data.DataFileType, dataFiles.cipher)
+	if err != nil || dataFile == nil {
+		return err
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	fileSize := fileReport.Size
+	dataFiles.sizes[fileId] = fileSize
+
+	fileName := fileReport.FileName
+	offset := dataFile.HeaderSize()
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			recordReadProblem(report, fileName, offset, fileSize, err)
+			break
+		}
+
+		_, seqNo := parseLogRecordKey(logRecord.Key)
+		if seqNo != nonTransactionSeqNo {
+			if logRecord.Type == data.LogRecordTxnFinished {
+				delete(uncommitted, seqNo)
+			} else if _, ok := uncommitted[seqNo]; !ok {
+				uncommitted[seqNo] = &VerifyProblem{
+					FileName: fileName,
+					Offset:   offset,
+					Kind:     ProblemUncommittedTxn,
+					Message:  fmt.Sprintf("transaction %d has no finished record", seqNo),
+				}
+			}
+		}
+
+		fileReport.Records++
+		fileReport.ValidSize += size
+		offset += size
+	}
+	return nil
+}
+
+// 检查 merge 生成的 hint 文件中的每一条索引是否指向了数据文件中对应 key 的有效记录
+func verifyHintFile(report *VerifyReport, dataFiles *verifyDataFiles) error {
+	filePath := filepath.Join(dataFiles.dirPath, data.HintFileName)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	fileReport := &VerifyFileReport{FileName: data.HintFileName}
+	hintFile, err := openVerifyFile(report, fileReport, filePath, 0, data.HintFileType, dataFiles.cipher)
+	if err != nil || hintFile == nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	offset := hintFile.HeaderSize()
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			recordReadProblem(report, data.HintFileName, offset, fileReport.Size, err)
+			break
+		}
+		fileReport.Records++
+		fileReport.ValidSize += size
+
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if err := verifyHintPos(report, dataFiles, data.HintFileName, offset, logRecord.Key, pos); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// 检查单个数据文件的 hint 文件，hint 文件需要以标识写完整的记录结尾，其中的位置都指向这个数据文件
+func verifyDataHintFile(report *VerifyReport, dataFiles *verifyDataFiles, fileId uint32) error {
+	filePath := data.GetHintFileName(dataFiles.dirPath, fileId)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	fileName := filepath.Base(filePath)
+	fileReport := &VerifyFileReport{FileName: fileName}
+	hintFile, err := openVerifyFile(report, fileReport, filePath, fileId, data.HintFileType, dataFiles.cipher)
+	if err != nil || hintFile == nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var finished bool
+	offset := hintFile.HeaderSize()
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			recordReadProblem(report, fileName, offset, fileReport.Size, err)
+			break
+		}
+		fileReport.Records++
+		fileReport.ValidSize += size
+
+		switch {
+		case finished:
+			report.addProblem(fileName, offset, ProblemInvalidFile, "record after the hint finished record")
+		case string(logRecord.Key) == hintFinishedKey:
+			finished = true
+			coveredSize, err := strconv.ParseInt(string(logRecord.Value), 10, 64)
+			if err != nil {
+				report.addProblem(fileName, offset, ProblemInvalidFile, "invalid covered size %q", logRecord.Value)
+			} else if dataFileSize, ok := dataFiles.sizes[fileId]; ok && coveredSize > dataFileSize {
+				report.addProblem(fileName, offset, ProblemPosOutOfRange,
+					"covers %d bytes past the end of data file %d", coveredSize-dataFileSize, fileId)
+			}
+		default:
+			pos := data.DecodeLogRecordPos(logRecord.Value)
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			if pos.Fid != fileId {
+				report.addProblem(fileName, offset, ProblemDanglingHint,
+					"key %q points to data file %d instead of %d", realKey, pos.Fid, fileId)
+			} else if err := verifyHintPos(report, dataFiles, fileName, offset, realKey, pos); err != nil {
+				return err
+			}
+		}
+		offset += size
+	}
+	if !finished {
+		report.addProblem(fileName, offset, ProblemTornRecord, "hint file has no finished record")
+	}
+	return nil
+}
+
+// 检查 hint 文件中的位置是否指向了数据文件中 key 对应的有效记录
+func verifyHintPos(report *VerifyReport, dataFiles *verifyDataFiles, fileName string, offset int64,
+	key []byte, pos *data.LogRecordPos) error {
+	dataFileSize, ok := dataFiles.sizes[pos.Fid]
+	if !ok {
+		report.addProblem(fileName, offset, ProblemDanglingHint,
+			"key %q points to missing or invalid data file %d", key, pos.Fid)
+		return nil
+	}
+	if pos.Offset+int64(pos.Size) > dataFileSize {
+		report.addProblem(fileName, offset, ProblemPosOutOfRange,
+			"key %q points to %d+%d past the end of data file %d", key, pos.Offset, pos.Size, pos.Fid)
+		return nil
+	}
+	dataFile, err := dataFiles.get(pos.Fid)
+	if err != nil {
+		return err
+	}
+	record, _, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		report.addProblem(fileName, offset, ProblemDanglingHint,
+			"key %q points to an invalid record in data file %d: %v", key, pos.Fid, err)
+		return nil
+	}
+	if realKey, _ := parseLogRecordKey(record.Key); string(realKey) != string(key) {
+		report.addProblem(fileName, offset, ProblemDanglingHint,
+			"key %q points to a record of key %q in data file %d", key, realKey, pos.Fid)
+	}
+	return nil
+}
+
+// 检查只包含一条记录的元数据文件，例如 merge 完成标识文件和事务序列号文件
+func verifyMetaFile(report *VerifyReport, dirPath string, fileName string, parse func(value []byte) error) {
+	filePath := filepath.Join(dirPath, fileName)
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		report.addProblem(fileName, 0, ProblemInvalidFile, "%v", err)
+		return
+	}
+	fileReport := &VerifyFileReport{FileName: fileName, Size: stat.Size()}
+	report.Files = append(report.Files, fileReport)
+
+	metaFile, err := data.OpenFileReadOnly(filePath, 0, 0)
+	if err != nil {
+		report.addProblem(fileName, 0, ProblemInvalidFile, "%v", err)
+		return
+	}
+	defer func() {
+		_ = metaFile.Close()
+	}()
+
+	record, size, err := metaFile.ReadLogRecord(0)
+	if err != nil {
+		recordReadProblem(report, fileName, 0, stat.Size(), err)
+		return
+	}
+	if err := parse(record.Value); err != nil {
+		report.addProblem(fileName, 0, ProblemInvalidFile, "invalid value %q: %v", record.Value, err)
+		return
+	}
+	fileReport.Records = 1
+	fileReport.ValidSize = size
+}
+
+// 检查 B+ 树索引中的位置是否超出了数据文件的末尾
+func verifyBPlusTreeIndex(report *VerifyReport, dirPath string, cipher *data.Cipher, fileSizes map[uint32]int64) {
+	bptree, err := index.OpenBPlusTreeReadOnly(dirPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		report.addProblem(index.BPlusTreeIndexFileName, 0, ProblemInvalidFile, "%v", err)
+		return
+	}
+	defer func() {
+		_ = bptree.Close()
+	}()
+
+	// 加密的索引需要解密之后才能读取位置信息
+	if bptree.Encrypted() {
+		if cipher == nil {
+			return
+		}
+		if err := bptree.SetCipher(cipher); err != nil {
+			report.addProblem(index.BPlusTreeIndexFileName, 0, ProblemInvalidFile, "%v", err)
+			return
+		}
+	}
+
+	fileReport := &VerifyFileReport{FileName: index.BPlusTreeIndexFileName}
+	report.Files = append(report.Files, fileReport)
+	iterator := bptree.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		fileReport.Records++
+		pos := iterator.Value()
+		dataFileSize, ok := fileSizes[pos.Fid]
+		if !ok {
+			report.addProblem(index.BPlusTreeIndexFileName, 0, ProblemDanglingHint,
+				"key %q points to missing data file %d", iterator.Key(), pos.Fid)
+			continue
+		}
+		if pos.Offset+int64(pos.Size) > dataFileSize {
+			report.addProblem(index.BPlusTreeIndexFileName, 0, ProblemPosOutOfRange,
+				"key %q points to %d+%d past the end of data file %d", iterator.Key(), pos.Offset, pos.Size, pos.Fid)
+		}
+	}
+}
+
+// 将读取记录时遇到的错误转换为对应的问题
+func recordReadProblem(report *VerifyReport, fileName string, offset int64, fileSize int64, err error) {
+	switch err {
+	case io.EOF:
+		if offset < fileSize {
+			report.addProblem(fileName, offset, ProblemTornRecord, "%d unreadable bytes at the end of file", fileSize-offset)
+		}
+	case io.ErrUnexpectedEOF:
+		report.addProblem(fileName, offset, ProblemTornRecord, "record exceeds the end of file")
+	case data.ErrInvalidCRC:
+		report.addProblem(fileName, offset, ProblemInvalidCRC, "invalid crc")
+	default:
+		report.addProblem(fileName, offset, ProblemInvalidFile, "%v", err)
+	}
+}
+
+// 读取数据文件中所有有效的记录，遇到损坏的记录时逐字节向后查找下一条有效的记录
+// 文件头无效的数据文件无法解析，已经记录在检查结果中，直接跳过
+func salvageDataFile(dirPath string, fileId uint32, cipher *data.Cipher, fn func(logRecord *data.LogRecord) error) error {
+	dataFile, err := data.OpenFileReadOnly(data.GetDataFileName(dirPath, fileId), fileId, data.DataFileType)
+	if err != nil {
+		if isFileHeaderError(err) {
+			return nil
+		}
+		return err
+	}
+	dataFile.Cipher = cipher
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	fileSize := dataFile.WriteOff
+
+	offset := dataFile.HeaderSize()
+	for offset < fileSize {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != data.ErrInvalidCRC {
+				return err
+			}
+			offset++
+			continue
+		}
+		if err := fn(logRecord); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}